@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/go-kit/log/level"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// getExisting returns which of crc32s are stored in the images table, with
+// a single query for the whole batch.
+func getExisting(ctx context.Context, roach *pgxpool.Pool, crc32s []uint32) (map[uint32]bool, error) {
+	ctx, span := tracer.Start(ctx, "db.existing")
+	defer span.End()
+
+	keys := make([]int64, len(crc32s))
+	for i, c := range crc32s {
+		keys[i] = int64(c)
+	}
+	var existing map[uint32]bool
+	err := retryConn(ctx, "existing", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			existing = make(map[uint32]bool, len(crc32s))
+			rows, err := tx.Query(ctx, "SELECT DISTINCT crc32 FROM images WHERE crc32 = ANY($1)", keys)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var c int64
+				if err := rows.Scan(&c); err != nil {
+					return err
+				}
+				existing[uint32(c)] = true
+			}
+			return rows.Err()
+		})
+	})
+	return existing, err
+}
+
+// validateBatchCheck checks that -db-batch-check can rule out duplicates. A
+// crc32 missing from the table only rules them out when the dedup keys
+// compare the content.
+func (svc *ImgDeduper) validateBatchCheck() error {
+	if svc.BatchCheck <= 0 || len(svc.DedupKeys) == 0 {
+		return nil
+	}
+	for _, k := range svc.DedupKeys {
+		if k == "hash" || k == "crc32" {
+			return nil
+		}
+	}
+	return errors.New("db batch check requires hash or crc32 among the dedup keys")
+}
+
+// unstoredSet holds the names the batch check found no stored crc32 for.
+// processImage takes a name out once, skipping its dedup lookup.
+type unstoredSet struct {
+	names sync.Map
+}
+
+func (u *unstoredSet) add(name string) {
+	u.names.Store(name, struct{}{})
+}
+
+// take reports whether name was found unstored, and forgets it.
+func (u *unstoredSet) take(name string) bool {
+	_, ok := u.names.LoadAndDelete(name)
+	return ok
+}
+
+// batchCheckSource reads the objects of b a batch at a time and looks their
+// crc32 up with one query, marking the objects whose crc32 isn't stored.
+type batchCheckSource struct {
+	svc  *ImgDeduper
+	b    objectSource
+	size int
+	buf  []*storage.ObjectAttrs
+	err  error
+}
+
+// batchCheck returns b, checked a batch at a time with -db-batch-check.
+func (svc *ImgDeduper) batchCheck(b objectSource) objectSource {
+	if svc.BatchCheck <= 0 {
+		return b
+	}
+	return &batchCheckSource{svc: svc, b: b, size: svc.BatchCheck}
+}
+
+func (s *batchCheckSource) Next() (*storage.ObjectAttrs, error) {
+	if len(s.buf) == 0 {
+		// the error ending a batch is returned once it is drained
+		if s.err != nil {
+			return nil, s.err
+		}
+		s.fill()
+		if len(s.buf) == 0 {
+			return nil, s.err
+		}
+	}
+	attrs := s.buf[0]
+	s.buf = s.buf[1:]
+	return attrs, nil
+}
+
+// fill reads the next batch and marks its unstored objects. A failed check
+// only loses the shortcut, every object is then looked up on its own.
+func (s *batchCheckSource) fill() {
+	for len(s.buf) < s.size {
+		attrs, err := s.b.Next()
+		if err != nil {
+			s.err = err
+			break
+		}
+		s.buf = append(s.buf, attrs)
+	}
+
+	// a zero crc32 may be missing rather than computed
+	crc32s := make([]uint32, 0, len(s.buf))
+	for _, attrs := range s.buf {
+		if attrs.CRC32C != 0 {
+			crc32s = append(crc32s, attrs.CRC32C)
+		}
+	}
+	if len(crc32s) == 0 {
+		return
+	}
+	existing, err := getExisting(s.svc.Context, s.svc.Roach, crc32s)
+	if err != nil {
+		level.Warn(loggerFromContext(s.svc.Context)).Log("msg", "batch check failed, looking objects up one by one", "objects", len(s.buf), "error", err)
+		return
+	}
+	for _, attrs := range s.buf {
+		if attrs.CRC32C != 0 && !existing[attrs.CRC32C] {
+			s.svc.unstored.add(attrs.Name)
+		}
+	}
+	s.svc.metrics.batchChecks.Inc()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	bigquery "google.golang.org/api/bigquery/v2"
+)
+
+const (
+	defaultBigQueryBatch = 500
+	// bigQueryFlushInterval bounds how long an event waits for a full batch.
+	bigQueryFlushInterval = 10 * time.Second
+	// bigQueryMaxBatches bounds the rows buffered while inserts are failing,
+	// events past it are dropped rather than growing memory.
+	bigQueryMaxBatches = 20
+)
+
+// bigQuerySink streams object events to a BigQuery table through the
+// insertAll API. Events are buffered and sent in batches by a background
+// goroutine, Close sends the tail.
+type bigQuerySink struct {
+	ctx     context.Context
+	svc     *bigquery.TabledataService
+	project string
+	dataset string
+	table   string
+	runID   string
+	batch   int
+
+	mu    sync.Mutex
+	rows  []*bigquery.TableDataInsertAllRequestRows
+	flush chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// parseBigQueryTable splits a project.dataset.table or project:dataset.table
+// name.
+func parseBigQueryTable(name string) (string, string, string, error) {
+	p := strings.Split(strings.Replace(name, ":", ".", 1), ".")
+	if len(p) != 3 || p[0] == "" || p[1] == "" || p[2] == "" {
+		return "", "", "", fmt.Errorf("invalid bigquery table %q, expected project.dataset.table", name)
+	}
+	return p[0], p[1], p[2], nil
+}
+
+// newBigQuerySink starts a sink writing to table with ADC. The table must
+// exist, rows carry the run id, the event fields and a timestamp.
+func newBigQuerySink(ctx context.Context, table, runID string, batch int) (*bigQuerySink, error) {
+	project, dataset, name, err := parseBigQueryTable(table)
+	if err != nil {
+		return nil, err
+	}
+	if batch < 1 {
+		return nil, fmt.Errorf("bigquery batch must be positive, got %d", batch)
+	}
+	bq, err := bigquery.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &bigQuerySink{
+		ctx:     ctx,
+		svc:     bq.Tabledata,
+		project: project,
+		dataset: dataset,
+		table:   name,
+		runID:   runID,
+		batch:   batch,
+		flush:   make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Emit buffers ev, waking the sender once a batch is full.
+func (s *bigQuerySink) Emit(ev ObjectEvent) error {
+	row := &bigquery.TableDataInsertAllRequestRows{
+		// best effort dedup of retried inserts
+		InsertId: s.runID + "/" + ev.Name,
+		Json: map[string]bigquery.JsonValue{
+			"run_id":    s.runID,
+			"name":      ev.Name,
+			"status":    ev.Status,
+			"crc32":     ev.CRC32,
+			"size":      ev.Size,
+			"original":  ev.Original,
+			"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.rows) >= s.batch*bigQueryMaxBatches {
+		return errors.New("bigquery buffer full, dropping event")
+	}
+	s.rows = append(s.rows, row)
+	if len(s.rows) >= s.batch {
+		select {
+		case s.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// run sends full batches as they fill up and partial ones on every tick.
+func (s *bigQuerySink) run() {
+	defer close(s.done)
+	l := loggerFromContext(s.ctx)
+	t := time.NewTicker(bigQueryFlushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.flush:
+		case <-t.C:
+		}
+		if err := s.send(s.ctx); err != nil {
+			level.Error(l).Log("msg", "failed to stream events to bigquery", "table", s.table, "error", err)
+		}
+	}
+}
+
+// send inserts the buffered rows a batch at a time. Rows of a failed request
+// are put back for the next attempt.
+func (s *bigQuerySink) send(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		n := len(s.rows)
+		if n > s.batch {
+			n = s.batch
+		}
+		rows := s.rows[:n:n]
+		s.rows = s.rows[n:]
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		resp, err := s.svc.InsertAll(s.project, s.dataset, s.table, &bigquery.TableDataInsertAllRequest{
+			Rows: rows,
+		}).Context(ctx).Do()
+		if err != nil {
+			s.mu.Lock()
+			s.rows = append(rows, s.rows...)
+			s.mu.Unlock()
+			return err
+		}
+		// rejected rows are invalid, resending them can't succeed
+		if len(resp.InsertErrors) > 0 {
+			var reason string
+			if e := resp.InsertErrors[0]; len(e.Errors) > 0 {
+				reason = e.Errors[0].Message
+			}
+			return fmt.Errorf("bigquery rejected %d of %d rows: %s", len(resp.InsertErrors), n, reason)
+		}
+	}
+}
+
+// Close stops the sender and inserts the remaining events.
+func (s *bigQuerySink) Close(ctx context.Context) error {
+	close(s.stop)
+	<-s.done
+	return s.send(ctx)
+}
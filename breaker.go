@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// breaker states, the circuit_breaker_state values
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+// breakerPoll is how often calls waiting on a half-open breaker check
+// whether its probe closed it.
+const breakerPoll = time.Second
+
+// breaker stops calls to a failing dependency. threshold consecutive
+// dependency failures open it, calls then wait out cooldown instead of
+// failing. A single probe call goes through once cooldown has passed, its
+// success closes the breaker and its failure opens it again. A nil breaker
+// lets every call through.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	// trips reports whether err is a failure of the dependency rather than
+	// of the call
+	trips func(error) bool
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+
+	stateGauge prometheus.Gauge
+	tripCount  prometheus.Counter
+}
+
+// newBreaker returns the breaker of dependency name, nil when threshold
+// disables it.
+func newBreaker(name string, threshold int, cooldown time.Duration, trips func(error) bool, m *metrics) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	b := &breaker{
+		name:       name,
+		threshold:  threshold,
+		cooldown:   cooldown,
+		trips:      trips,
+		stateGauge: m.breakerState.With(prometheus.Labels{"dependency": name}),
+		tripCount:  m.breakerTrips.With(prometheus.Labels{"dependency": name}),
+	}
+	b.stateGauge.Set(breakerClosed)
+	return b
+}
+
+// validateBreaker checks the breaker flags.
+func (svc *ImgDeduper) validateBreaker() error {
+	if svc.BreakerLimit < 0 {
+		return fmt.Errorf("breaker threshold %d is negative", svc.BreakerLimit)
+	}
+	if svc.BreakerLimit > 0 && svc.BreakerPause <= 0 {
+		return fmt.Errorf("breaker cooldown %s must be positive", svc.BreakerPause)
+	}
+	return nil
+}
+
+// do runs fn once the breaker lets it through and records its outcome.
+func (b *breaker) do(ctx context.Context, fn func() error) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(ctx, err)
+	return err
+}
+
+// wait blocks while the breaker is open, or half-open with its probe in
+// flight, and returns once the call may go through or ctx is done.
+func (b *breaker) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		delay := breakerPoll
+		switch b.state {
+		case breakerClosed:
+			b.mu.Unlock()
+			return nil
+		case breakerOpen:
+			left := time.Until(b.openedAt.Add(b.cooldown))
+			if left <= 0 {
+				// this call is the probe
+				b.setState(ctx, breakerHalfOpen)
+				b.mu.Unlock()
+				return nil
+			}
+			delay = left
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// record counts the outcome of a call. Errors that aren't dependency
+// failures count as a success, the dependency answered.
+func (b *breaker) record(ctx context.Context, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// a cancelled call tells nothing, a cancelled probe hands over to the
+	// next caller
+	if ctx.Err() != nil {
+		if b.state == breakerHalfOpen {
+			b.state = breakerOpen
+			b.stateGauge.Set(breakerOpen)
+		}
+		return
+	}
+
+	if err == nil || !b.trips(err) {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(ctx, breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.tripCount.Inc()
+		b.setState(ctx, breakerOpen)
+		level.Warn(loggerFromContext(ctx)).Log("msg", "circuit breaker open, pausing calls", "dependency", b.name, "failures", b.failures, "cooldown", b.cooldown, "error", err)
+	}
+}
+
+// setState moves the breaker to state, b.mu held.
+func (b *breaker) setState(ctx context.Context, state int) {
+	b.state = state
+	b.stateGauge.Set(float64(state))
+	switch state {
+	case breakerHalfOpen:
+		level.Info(loggerFromContext(ctx)).Log("msg", "circuit breaker half-open, probing", "dependency", b.name)
+	case breakerClosed:
+		level.Info(loggerFromContext(ctx)).Log("msg", "circuit breaker closed", "dependency", b.name)
+	}
+}
+
+// isGCSOutage reports whether err is a GCS failure worth backing off from,
+// rate limiting, a server error or a broken connection. storage.ShouldRetry
+// doesn't follow errors joining two, e.g. ErrCopy and its cause.
+func isGCSOutage(err error) bool {
+	if storage.ShouldRetry(err) {
+		return true
+	}
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			if isGCSOutage(err) {
+				return true
+			}
+		}
+	case interface{ Unwrap() error }:
+		return isGCSOutage(e.Unwrap())
+	}
+	return false
+}
+
+type ctxBreaker struct{}
+
+// contextWithBreaker adds the database breaker to ctx for the database
+// helpers, see retryConn.
+func contextWithBreaker(ctx context.Context, b *breaker) context.Context {
+	return context.WithValue(ctx, ctxBreaker{}, b)
+}
+
+// breakerFromContext returns the database breaker, nil when ctx has none.
+func breakerFromContext(ctx context.Context) *breaker {
+	b, _ := ctx.Value(ctxBreaker{}).(*breaker)
+	return b
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// defaultCheckpointEvery is the number of handled objects between two
+// -checkpoint-file writes.
+const defaultCheckpointEvery = 1000
+
+// checkpointState is the content of -checkpoint-file. The listing it was
+// written for is recorded so another listing doesn't resume from it.
+type checkpointState struct {
+	StartAfter string    `json:"start_after"`
+	Glob       string    `json:"glob"`
+	ShardIndex int       `json:"shard_index"`
+	ShardCount int       `json:"shard_count"`
+	Handled    int64     `json:"handled"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// readCheckpoint returns the name a scan of glob resumes after from path. A
+// missing, corrupt or foreign file is logged and the scan starts from the
+// beginning.
+func (svc *ImgDeduper) readCheckpoint(path, glob string) string {
+	l := loggerFromContext(svc.Context)
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		level.Info(l).Log("msg", "no checkpoint file, listing from the beginning", "path", path)
+		return ""
+	}
+	if err != nil {
+		level.Warn(l).Log("msg", "failed to read checkpoint file, listing from the beginning", "path", path, "error", err)
+		return ""
+	}
+	var st checkpointState
+	if err := json.Unmarshal(b, &st); err != nil {
+		level.Warn(l).Log("msg", "corrupt checkpoint file, listing from the beginning", "path", path, "error", err)
+		return ""
+	}
+	if st.Glob != glob || st.ShardIndex != svc.ShardIndex || st.ShardCount != svc.ShardCount {
+		level.Warn(l).Log("msg", "checkpoint file is for another listing, listing from the beginning", "path", path,
+			"glob", st.Glob, "shard_index", st.ShardIndex, "shard_count", st.ShardCount)
+		return ""
+	}
+	level.Info(l).Log("msg", "resuming from checkpoint file", "path", path, "start_after", st.StartAfter, "updated_at", st.UpdatedAt)
+	return st.StartAfter
+}
+
+// checkpointTracker follows the listed objects to the last one that, with
+// every object listed before it, has been handled, and writes it to the
+// checkpoint file every so many handled objects. Workers finish objects out
+// of listing order, so the last listed object isn't safe to resume after
+// until then. An object whose copy outlives its worker, on the copy stage or
+// as a queued retry, is held until the copy settles. A nil tracker follows
+// nothing.
+type checkpointTracker struct {
+	path  string
+	every int
+	state checkpointState
+	l     log.Logger
+
+	mu      sync.Mutex
+	pending []string
+	done    map[string]int
+	holds   map[string]int
+	since   int
+}
+
+func newCheckpointTracker(path string, every int, st checkpointState, l log.Logger) *checkpointTracker {
+	if every < 1 {
+		every = defaultCheckpointEvery
+	}
+	return &checkpointTracker{path: path, every: every, state: st, l: l, done: make(map[string]int), holds: make(map[string]int)}
+}
+
+// listed records that name was dispatched, in listing order.
+func (t *checkpointTracker) listed(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.pending = append(t.pending, name)
+	t.mu.Unlock()
+}
+
+// handled records that the worker is done with name and writes the
+// checkpoint once every objects were handled since the last write.
+func (t *checkpointTracker) handled(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.done[name]++
+	t.advance()
+	t.state.Handled++
+	if t.since++; t.since >= t.every {
+		t.write()
+	}
+}
+
+// hold keeps the checkpoint from moving past name until a matching settle,
+// the copy of name goes on after its worker is done with it.
+func (t *checkpointTracker) hold(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.holds[name]++
+	t.mu.Unlock()
+}
+
+// settle ends a hold on name, its copy or retry is done.
+func (t *checkpointTracker) settle(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.holds[name]--; t.holds[name] <= 0 {
+		delete(t.holds, name)
+	}
+	t.advance()
+}
+
+// advance moves the checkpoint past the handled objects at the front of the
+// listing that aren't held. t.mu held.
+func (t *checkpointTracker) advance() {
+	for len(t.pending) > 0 {
+		front := t.pending[0]
+		if t.done[front] == 0 || t.holds[front] > 0 {
+			return
+		}
+		if t.done[front]--; t.done[front] == 0 {
+			delete(t.done, front)
+		}
+		t.state.StartAfter = front
+		t.pending = t.pending[1:]
+	}
+}
+
+// finish writes the final checkpoint once the workers are done. A listing
+// that ran to its end removes the file, the next run starts over.
+func (t *checkpointTracker) finish(exhausted bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if exhausted {
+		if err := os.Remove(t.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			level.Warn(t.l).Log("msg", "failed to remove checkpoint file", "path", t.path, "error", err)
+			return
+		}
+		level.Info(t.l).Log("msg", "listing complete, checkpoint file removed", "path", t.path)
+		return
+	}
+	t.write()
+	level.Info(t.l).Log("msg", "checkpoint file written", "path", t.path, "start_after", t.state.StartAfter)
+}
+
+// write replaces the checkpoint file, through a rename so a process dying
+// mid-write leaves the previous checkpoint. t.mu held.
+func (t *checkpointTracker) write() {
+	t.since = 0
+	if t.state.StartAfter == "" {
+		return
+	}
+	t.state.UpdatedAt = time.Now().UTC()
+	if err := writeCheckpoint(t.path, t.state); err != nil {
+		level.Warn(t.l).Log("msg", "failed to write checkpoint file", "path", t.path, "error", err)
+	}
+}
+
+func writeCheckpoint(path string, st checkpointState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename %s: %w", tmp.Name(), err)
+	}
+	return nil
+}
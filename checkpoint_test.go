@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestCheckpointTrackerHold(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	tr := newCheckpointTracker(path, 1000, checkpointState{}, log.NewNopLogger())
+	for _, name := range []string{"a", "b", "c"} {
+		tr.listed(name)
+	}
+
+	// b's copy outlives its worker
+	tr.hold("b")
+	tr.handled("a")
+	tr.handled("b")
+	tr.handled("c")
+	if got := tr.state.StartAfter; got != "a" {
+		t.Fatalf("StartAfter with b held = %q, want a", got)
+	}
+
+	// a retry queued by the copy holds b again before the copy settles
+	tr.hold("b")
+	tr.settle("b")
+	if got := tr.state.StartAfter; got != "a" {
+		t.Fatalf("StartAfter with b's retry held = %q, want a", got)
+	}
+	tr.settle("b")
+	if got := tr.state.StartAfter; got != "c" {
+		t.Fatalf("StartAfter once b settled = %q, want c", got)
+	}
+}
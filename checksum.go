@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+)
+
+// -missing-crc32c behaviours for an object listed with a crc32c of 0
+const (
+	missingCRCStream = "stream"
+	missingCRCSkip   = "skip"
+	missingCRCIgnore = "ignore"
+)
+
+// castagnoli is the crc32c table GCS checksums with.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func validateMissingCRC(v string) error {
+	switch v {
+	case "", missingCRCStream, missingCRCSkip, missingCRCIgnore:
+		return nil
+	}
+	return fmt.Errorf("unknown missing crc32c behaviour %q, expected %s, %s or %s", v, missingCRCStream, missingCRCSkip, missingCRCIgnore)
+}
+
+// fillMissingCRC handles an object listed without a crc32c, e.g. uploaded
+// through a signed URL serving no x-goog-hash. Left at 0 it would match every
+// other such object. With stream the crc32c of the stored bytes is computed
+// into attrs, with skip false is returned and the object is left alone. An
+// object with a crc32c, or any object with ignore, is returned untouched.
+func (svc *ImgDeduper) fillMissingCRC(ctx context.Context, src *storage.BucketHandle, attrs *storage.ObjectAttrs) (bool, error) {
+	if attrs.CRC32C != 0 {
+		return true, nil
+	}
+	switch svc.MissingCRC {
+	case missingCRCSkip:
+		level.Warn(loggerFromContext(ctx)).Log("msg", "object has no crc32c, not deduped", "name", attrs.Name)
+		return false, nil
+	case missingCRCStream:
+		crc, err := svc.streamCRC32C(ctx, src.Object(attrs.Name), attrs.Name)
+		if err != nil {
+			return false, err
+		}
+		svc.metrics.crcComputed.Inc()
+		level.Debug(loggerFromContext(ctx)).Log("msg", "computed missing crc32c", "name", attrs.Name, "crc32", crc)
+		attrs.CRC32C = crc
+	}
+	return true, nil
+}
+
+// streamCRC32C downloads the object and returns the crc32c of its stored
+// bytes, without decompressive transcoding, as GCS would report it.
+func (svc *ImgDeduper) streamCRC32C(ctx context.Context, obj *storage.ObjectHandle, name string) (uint32, error) {
+	ctx, span := tracer.Start(ctx, "crc32c")
+	defer span.End()
+
+	var r io.ReadCloser
+	if svc.SrcURL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, svc.srcURL(name), nil)
+		if err != nil {
+			return 0, err
+		}
+		// an explicit Accept-Encoding keeps the client from decompressing
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return 0, fmt.Errorf("get: %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		var err error
+		if r, err = obj.ReadCompressed(true).NewReader(ctx); err != nil {
+			return 0, err
+		}
+	}
+	defer r.Close()
+
+	h := crc32.New(castagnoli)
+	if _, err := io.Copy(h, r); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/go-kit/log/level"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// clusterPage is the number of clusters read per query, so the report
+// streams tables of any size.
+const clusterPage = 1000
+
+// duplicateCluster is a group of stored images sharing a crc32. Canonical is
+// the image whose copy is kept, the others are redundant src objects.
+type duplicateCluster struct {
+	CRC32      uint32   `json:"crc32"`
+	Size       int64    `json:"size"`
+	Canonical  string   `json:"canonical"`
+	Duplicates []string `json:"duplicates"`
+}
+
+// getClusters returns up to limit clusters whose crc32 is above after, in
+// crc32 order. The canonical name is the first copied row by name, the row a
+// scan matches duplicates to, else the first row by name.
+func getClusters(ctx context.Context, roach *pgxpool.Pool, after int64, limit int) ([]*duplicateCluster, error) {
+	ctx, span := tracer.Start(ctx, "db.clusters")
+	defer span.End()
+
+	var clusters []*duplicateCluster
+	err := retryConn(ctx, "clusters", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			clusters = clusters[:0]
+			rows, err := tx.Query(ctx, `WITH c AS (
+					SELECT crc32 FROM images WHERE crc32 > $1
+					GROUP BY crc32 HAVING count(*) > 1 ORDER BY crc32 LIMIT $2
+				)
+				SELECT i.crc32, i.name, COALESCE(i.size, 0) FROM images i JOIN c ON i.crc32 = c.crc32
+				ORDER BY i.crc32, i.copied_at IS NULL, i.name`, after, limit)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			var cur *duplicateCluster
+			for rows.Next() {
+				var crc, size int64
+				var name string
+				if err := rows.Scan(&crc, &name, &size); err != nil {
+					return err
+				}
+				if cur == nil || cur.CRC32 != uint32(crc) {
+					cur = &duplicateCluster{CRC32: uint32(crc), Size: size, Canonical: name}
+					clusters = append(clusters, cur)
+					continue
+				}
+				cur.Duplicates = append(cur.Duplicates, name)
+			}
+			return rows.Err()
+		})
+	})
+	return clusters, err
+}
+
+// clusterWriter writes duplicate clusters as JSONL, a cluster per line, or
+// as CSV, a row per duplicate.
+type clusterWriter struct {
+	closer io.Closer
+	csv    *csv.Writer
+	json   *json.Encoder
+}
+
+// newClusterWriter opens path, - for stdout, in the given format.
+func newClusterWriter(path, format string) (*clusterWriter, error) {
+	if format != reportCSV && format != reportJSON {
+		return nil, fmt.Errorf("unknown report format %q, expected %s or %s", format, reportCSV, reportJSON)
+	}
+
+	var w io.WriteCloser = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	cw := &clusterWriter{closer: w}
+	if format == reportJSON {
+		cw.json = json.NewEncoder(w)
+		return cw, nil
+	}
+	cw.csv = csv.NewWriter(w)
+	if err := cw.csv.Write([]string{"crc32", "size", "canonical", "duplicate"}); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (w *clusterWriter) write(c *duplicateCluster) error {
+	if w.json != nil {
+		return w.json.Encode(c)
+	}
+	crc := strconv.FormatUint(uint64(c.CRC32), 10)
+	size := strconv.FormatInt(c.Size, 10)
+	for _, name := range c.Duplicates {
+		if err := w.csv.Write([]string{crc, size, c.Canonical, name}); err != nil {
+			return err
+		}
+	}
+	// flush every cluster so a long report can be followed
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+// Close flushes the report, stdout is left open.
+func (w *clusterWriter) Close() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if w.closer == os.Stdout {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+// reportClusters writes every group of stored images sharing a crc32, read a
+// page at a time. It only reads the images table, no bucket is listed. A
+// crc32 collision between different images shows up as a cluster too,
+// compare the size before deleting.
+func (svc *ImgDeduper) reportClusters() error {
+	l := loggerFromContext(svc.Context)
+
+	if svc.ReportFile == "" {
+		return errors.New("report mode requires -report-file")
+	}
+	w, err := newClusterWriter(svc.ReportFile, svc.ReportFormat)
+	if err != nil {
+		return err
+	}
+	level.Info(l).Log("msg", "duplicate cluster report started", "format", svc.ReportFormat)
+
+	var clusters, duplicates, redundant int64
+	after := int64(-1)
+	for {
+		page, perr := getClusters(svc.Context, svc.Roach, after, clusterPage)
+		if perr != nil {
+			err = perr
+			break
+		}
+		for _, c := range page {
+			if err = w.write(c); err != nil {
+				break
+			}
+			clusters++
+			duplicates += int64(len(c.Duplicates))
+			redundant += c.Size * int64(len(c.Duplicates))
+		}
+		if err != nil || len(page) < clusterPage {
+			break
+		}
+		after = int64(page[len(page)-1].CRC32)
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+
+	level.Info(l).Log("msg", "duplicate cluster summary",
+		"clusters", clusters,
+		"duplicates", duplicates,
+		"redundant_bytes", redundant)
+	return err
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"google.golang.org/api/googleapi"
+)
+
+// storageClasses are the storage classes accepted by GCS.
+var storageClasses = map[string]bool{
+	"STANDARD":                     true,
+	"NEARLINE":                     true,
+	"COLDLINE":                     true,
+	"ARCHIVE":                      true,
+	"MULTI_REGIONAL":               true,
+	"REGIONAL":                     true,
+	"DURABLE_REDUCED_AVAILABILITY": true,
+}
+
+func validateStorageClass(c string) error {
+	if c != "" && !storageClasses[c] {
+		return fmt.Errorf("invalid storage class %q", c)
+	}
+	return nil
+}
+
+// provenance metadata keys stamped on copies with -stamp-provenance
+const (
+	sourceBucketKey = "source-bucket"
+	sourceObjectKey = "source-object"
+	runIDKey        = "run-id"
+	copiedAtKey     = "copied-at"
+)
+
+// copyAttrs returns the destination attrs of a server-side copy, and false
+// when the copy should keep the source attrs untouched. Setting any attr
+// replaces the source's on the destination, so the content headers are
+// always carried over explicitly.
+func (svc *ImgDeduper) copyAttrs(attrs *storage.ObjectAttrs) (storage.ObjectAttrs, bool) {
+	if svc.StorageClass == "" && svc.KeepMetadata && len(svc.Metadata) == 0 && !svc.Provenance {
+		return storage.ObjectAttrs{}, false
+	}
+
+	a := storage.ObjectAttrs{
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentLanguage:    attrs.ContentLanguage,
+		ContentDisposition: attrs.ContentDisposition,
+		CacheControl:       attrs.CacheControl,
+		StorageClass:       svc.StorageClass,
+		Metadata:           map[string]string{},
+	}
+	if svc.KeepMetadata {
+		for k, v := range attrs.Metadata {
+			a.Metadata[k] = v
+		}
+	}
+	for k, v := range svc.Metadata {
+		a.Metadata[k] = v
+	}
+	// provenance overrides the source and -metadata keys so it can be trusted
+	if svc.Provenance {
+		bucket := attrs.Bucket
+		if bucket == "" {
+			bucket = svc.SrcBucketName
+		}
+		a.Metadata[sourceBucketKey] = bucket
+		a.Metadata[sourceObjectKey] = attrs.Name
+		a.Metadata[runIDKey] = svc.RunID
+		a.Metadata[copiedAtKey] = time.Now().UTC().Format(time.RFC3339)
+	}
+	return a, true
+}
+
+// copyConditions returns the preconditions of the copy to dstObj. By default
+// an existing dst object is never replaced. -overwrite replaces the generation
+// seen here and -overwrite-if-newer only does so when src was updated after
+// it. ok is false when the copy should be skipped.
+func (svc *ImgDeduper) copyConditions(ctx context.Context, dstObj *storage.ObjectHandle, attrs *storage.ObjectAttrs) (storage.Conditions, bool, error) {
+	if !svc.Overwrite && !svc.OverwriteNew {
+		return storage.Conditions{DoesNotExist: true}, true, nil
+	}
+
+	dstAttrs, err := dstObj.Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return storage.Conditions{DoesNotExist: true}, true, nil
+	}
+	if err != nil {
+		return storage.Conditions{}, false, err
+	}
+	if svc.OverwriteNew && !attrs.Updated.After(dstAttrs.Updated) {
+		return storage.Conditions{}, false, nil
+	}
+	// fail rather than replace a generation written since the check
+	return storage.Conditions{GenerationMatch: dstAttrs.Generation}, true, nil
+}
+
+// kmsKeyName matches a Cloud KMS crypto key resource name.
+var kmsKeyName = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// validateKMSKey checks the -kms-key options, empty disables CMEK.
+func (svc *ImgDeduper) validateKMSKey() error {
+	if svc.KMSKey == "" {
+		return nil
+	}
+	if !kmsKeyName.MatchString(svc.KMSKey) {
+		return fmt.Errorf("kms key %q, expected projects/P/locations/L/keyRings/R/cryptoKeys/K", svc.KMSKey)
+	}
+	if svc.Transform || svc.SrcURL != "" {
+		return errors.New("kms key only applies to server-side copies, not -transform or -src-url")
+	}
+	return nil
+}
+
+// kmsHint adds the fix for a copy refused because the key can't be used.
+func (svc *ImgDeduper) kmsHint(err error) error {
+	var apiErr *googleapi.Error
+	if svc.KMSKey == "" || !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return err
+	}
+	return fmt.Errorf("%w, grant the dst project's Cloud Storage service agent roles/cloudkms.cryptoKeyEncrypterDecrypter on %s", err, svc.KMSKey)
+}
+
+// isPreconditionFailed reports whether err is a failed copy precondition, the
+// dst object changed since its conditions were computed.
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// checkExistingCopy checks the dst object a copy precondition found in place
+// like a fresh copy, see checkCopyCRC, so that a corrupt copy left by an
+// earlier run isn't marked copied as the original. Transformed copies and
+// sources without a crc32c aren't compared.
+func (svc *ImgDeduper) checkExistingCopy(ctx context.Context, dst *storage.BucketHandle, dstName string, attrs *storage.ObjectAttrs) error {
+	if svc.Transform || attrs.CRC32C == 0 {
+		return nil
+	}
+	dstAttrs, err := dst.Object(dstName).Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: dst attrs: %w", ErrCopy, err)
+	}
+	return svc.checkCopyCRC(ctx, dst, dstName, attrs, dstAttrs)
+}
+
+// checkCopyCRC compares the crc32c GCS reports for the copied object with the
+// source's. On mismatch the destination object and the image row are
+// optionally removed so a later run copies the object again. The returned
+// error is classed ErrCopy and ErrCRCMismatch, or ErrDelete when the removal
+// failed. A mismatch is never retried within the run.
+func (svc *ImgDeduper) checkCopyCRC(ctx context.Context, dst *storage.BucketHandle, dstName string, attrs, dstAttrs *storage.ObjectAttrs) error {
+	if dstAttrs.CRC32C == attrs.CRC32C {
+		return nil
+	}
+
+	errLog := svc.errLogger(ctx)
+	svc.metrics.copyCRCMismatch.Inc()
+	level.Error(errLog).Log("msg", "CRC32C MISMATCH AFTER COPY", "name", attrs.Name, "dst", dstName, "src_crc32", attrs.CRC32C, "dst_crc32", dstAttrs.CRC32C)
+	mismatch := fmt.Errorf("%w: %w, src %d dst %d", ErrCopy, ErrCRCMismatch, attrs.CRC32C, dstAttrs.CRC32C)
+	if !svc.DropMismatch {
+		return mismatch
+	}
+
+	if err := dst.Object(dstName).Generation(dstAttrs.Generation).Delete(ctx); err != nil {
+		level.Error(errLog).Log("msg", "failed to delete mismatched dst object", "dst", dstName, "error", err)
+		return fmt.Errorf("%w: %w", ErrDelete, err)
+	}
+	if err := deleteImage(ctx, svc.Roach, attrs.Name); err != nil {
+		level.Error(errLog).Log("msg", "failed to delete image row for retry", "name", attrs.Name, "error", err)
+		return fmt.Errorf("%w: %w", ErrDelete, err)
+	}
+	level.Warn(errLog).Log("msg", "deleted mismatched copy, object will be retried on the next run", "name", attrs.Name, "dst", dstName)
+	return mismatch
+}
+
+// copyImage copies a new image to dstName. It returns the copy status, a
+// skip status when the copy preconditions rule it out, and an error classed
+// ErrCopy or ErrDelete. While the GCS breaker is open it waits instead.
+func (svc *ImgDeduper) copyImage(ctx context.Context, src, dst *storage.BucketHandle, dstName string, attrs *storage.ObjectAttrs) (string, error) {
+	if err := svc.gcs.wait(ctx); err != nil {
+		return "copy", fmt.Errorf("%w: %w", ErrCopy, err)
+	}
+	status, err := svc.copyObject(ctx, src, dst, dstName, attrs)
+	svc.gcs.record(ctx, err)
+	return status, err
+}
+
+func (svc *ImgDeduper) copyObject(ctx context.Context, src, dst *storage.BucketHandle, dstName string, attrs *storage.ObjectAttrs) (string, error) {
+	srcObj := src.Object(attrs.Name)
+	dstObj := dst.Object(dstName)
+	// https://cloud.google.com/storage/docs/copying-renaming-moving-objects#client-libraries
+	// The copy runs as the dst identity, which therefore also needs read access to src.
+	conds, ok, err := svc.copyConditions(ctx, dstObj, attrs)
+	if err != nil {
+		return "copy", fmt.Errorf("%w: dst attrs: %w", ErrCopy, err)
+	}
+	if !ok {
+		return "skip_not_newer", nil
+	}
+	dstObj = dstObj.If(conds)
+
+	ctx, span := tracer.Start(ctx, "gcs.copy")
+	defer span.End()
+
+	switch {
+	case svc.SrcURL != "":
+		err = httpSourceCopy(ctx, svc.srcURL(attrs.Name), dstObj)
+	case svc.Transform:
+		err = transformAndCopy(ctx, srcObj, dstObj, svc.JPEGQuality, svc.ChunkSize)
+	default:
+		c := dstObj.CopierFrom(srcObj)
+		if a, ok := svc.copyAttrs(attrs); ok {
+			c.ObjectAttrs = a
+		}
+		c.DestinationKMSKeyName = svc.KMSKey
+		var dstAttrs *storage.ObjectAttrs
+		if dstAttrs, err = c.Run(ctx); err == nil {
+			return "copy", svc.checkCopyCRC(ctx, dst, dstName, attrs, dstAttrs)
+		}
+	}
+	if isPreconditionFailed(err) {
+		return "skip_precondition", svc.checkExistingCopy(ctx, dst, dstName, attrs)
+	}
+	if err != nil {
+		return "copy", fmt.Errorf("%w: %w", ErrCopy, svc.kmsHint(err))
+	}
+	return "copy", nil
+}
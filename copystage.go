@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// copyJob is the copy of a new image whose row is stored, handed over by
+// processImage with the object's context, timeout and span, or a failed copy
+// due for a retry.
+type copyJob struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	span    trace.Span
+	src     *storage.BucketHandle
+	dst     *storage.BucketHandle
+	attrs   *storage.ObjectAttrs
+	dstName string
+	section string
+	retry   *copyRetry
+}
+
+// copyStage runs the copies of new images on -copy-workers goroutines, apart
+// from the workers doing the hashing and database work, so both can be sized
+// on their own.
+type copyStage struct {
+	jobs    chan *copyJob
+	pending sync.WaitGroup
+	wg      sync.WaitGroup
+}
+
+// startCopyStage starts workers copy workers reading a queue of size jobs.
+func (svc *ImgDeduper) startCopyStage(workers, size int) *copyStage {
+	c := &copyStage{jobs: make(chan *copyJob, size)}
+	for i := 0; i < workers; i++ {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			// the copy runs with the context of the object's worker, the
+			// copy worker's own connection replaces the worker's pinned one
+			var pinned *pinnedConn
+			if svc.PinConns && svc.Roach != nil {
+				pinned = &pinnedConn{pool: svc.Roach}
+				defer pinned.release()
+			}
+			for j := range c.jobs {
+				if j.retry != nil {
+					svc.retryCopy(contextWithConn(svc.Context, pinned), j.retry)
+					svc.retries.finish()
+					continue
+				}
+				j.ctx = contextWithConn(j.ctx, pinned)
+				svc.stageCopy(j)
+				c.pending.Done()
+			}
+		}()
+	}
+	return c
+}
+
+// submit queues the copy of a new image, blocking while the queue is full.
+func (c *copyStage) submit(j *copyJob) {
+	c.pending.Add(1)
+	c.jobs <- j
+}
+
+// wait blocks until every submitted copy is done, retries excluded.
+func (c *copyStage) wait() {
+	c.pending.Wait()
+}
+
+// stop ends the copy workers once the queue is drained.
+func (c *copyStage) stop() {
+	close(c.jobs)
+	c.wg.Wait()
+}
+
+// stageCopy copies a new image handed over by processImage and finishes the
+// object. Its row is stored, so a failed copy is retried alone and only a
+// stored copy marks the row copied.
+func (svc *ImgDeduper) stageCopy(j *copyJob) {
+	l := loggerFromContext(j.ctx)
+	errLog := svc.errLogger(j.ctx)
+	attrs, s := j.attrs, j.section
+	status := "copy"
+	var failure error
+	defer func() {
+		svc.sections.release(s)
+		svc.progress.settle(attrs.Name)
+		svc.finishObject(j.ctx, j.span, attrs, status, "", failure)
+		j.cancel()
+	}()
+
+	level.Debug(l).Log("msg", "init copy", "section", s, "name", attrs.Name, "dst", j.dstName, "count", 0, "crc32", attrs.CRC32C)
+	status, err := svc.copyImage(j.ctx, j.src, j.dst, j.dstName, attrs)
+	if err != nil || status != "copy" {
+		svc.releaseCopy()
+	}
+	if err != nil {
+		failure = err
+		svc.countObject("error", "copy", s)
+		level.Error(errLog).Log("msg", "copy", "section", s, "name", attrs.Name, "dst", j.dstName, "crc32", attrs.CRC32C, "error", err)
+		// a mismatch is left to the next run, see processImage
+		if !errors.Is(err, ErrDelete) && !errors.Is(err, ErrCRCMismatch) {
+			svc.retryLater(j.ctx, &copyRetry{src: j.src, dst: j.dst, attrs: attrs, dstName: j.dstName, section: s}, err)
+		}
+		return
+	}
+
+	// a skipped copy found the image in dst already, with the source's crc32c
+	if err := markCopied(j.ctx, svc.Roach, attrs.Name, svc.staging()); err != nil {
+		failure = fmt.Errorf("%w: %w", ErrInsert, err)
+		svc.countObject("error", "insert", s)
+		level.Error(errLog).Log("msg", "failed to mark image copied", "name", attrs.Name, "error", failure)
+		return
+	}
+
+	if status == "copy" {
+		level.Debug(l).Log("msg", "copy", "section", s, "name", attrs.Name, "count", 0, "crc32", attrs.CRC32C)
+	}
+	svc.countObject("success", status, s)
+	level.Info(l).Log("msg", "image", "section", s, "name", attrs.Name, "count", 0, "original", "", "crc32", attrs.CRC32C, "status", status)
+}
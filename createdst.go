@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+)
+
+// defaultDstLocation is the location of a dst bucket created by -create-dst.
+const defaultDstLocation = "US"
+
+// ensureDstBucket creates the dst bucket with -create-dst unless it exists,
+// in -create-dst-project, or the -dst-project billed for dst requests.
+func (svc *ImgDeduper) ensureDstBucket(ctx context.Context, dst *storage.BucketHandle) error {
+	l := loggerFromContext(ctx)
+
+	_, err := dst.Attrs(ctx)
+	switch {
+	case err == nil:
+		level.Info(l).Log("msg", "dst bucket exists, not creating it", "name", svc.DstBucketName)
+		return nil
+	case isAPIStatus(err, http.StatusForbidden):
+		return fmt.Errorf("dst bucket %s: %w, the dst identity needs storage.buckets.get to check it exists", svc.DstBucketName, err)
+	case !errors.Is(err, storage.ErrBucketNotExist):
+		return fmt.Errorf("dst bucket %s: %w", svc.DstBucketName, err)
+	}
+
+	project := svc.CreateProject
+	if project == "" {
+		project = svc.DstProject
+	}
+	if project == "" {
+		return fmt.Errorf("dst bucket %s doesn't exist, creating it requires -create-dst-project", svc.DstBucketName)
+	}
+	attrs := &storage.BucketAttrs{Location: svc.CreateRegion, StorageClass: svc.CreateClass}
+	err = dst.Create(ctx, project, attrs)
+	switch {
+	case isAPIStatus(err, http.StatusConflict):
+		// created since the check, or the name is taken in another project
+		if _, aerr := dst.Attrs(ctx); aerr != nil {
+			return fmt.Errorf("dst bucket name %s is taken: %w", svc.DstBucketName, err)
+		}
+		level.Info(l).Log("msg", "dst bucket created concurrently", "name", svc.DstBucketName)
+		return nil
+	case isAPIStatus(err, http.StatusForbidden):
+		return fmt.Errorf("create dst bucket %s in project %s: %w, the dst identity needs storage.buckets.create on the project", svc.DstBucketName, project, err)
+	case err != nil:
+		return fmt.Errorf("create dst bucket %s in project %s: %w", svc.DstBucketName, project, err)
+	}
+	level.Info(l).Log("msg", "dst bucket created", "name", svc.DstBucketName, "project", project, "location", svc.CreateRegion, "storage_class", svc.CreateClass)
+	return nil
+}
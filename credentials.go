@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// ClientOptions select the identity a storage client authenticates as.
+// When all fields are empty the client falls back to ADC.
+type ClientOptions struct {
+	CredentialsFile string
+	WIFConfig       string
+	ImpersonateSA   string
+}
+
+// StorageOptions hold the identities used for the src and dst buckets.
+type StorageOptions struct {
+	Src ClientOptions
+	Dst ClientOptions
+}
+
+// IsSet reports whether the options override ADC.
+func (o ClientOptions) IsSet() bool {
+	return o.CredentialsFile != "" || o.WIFConfig != "" || o.ImpersonateSA != ""
+}
+
+// wifConfig is the part of an external account credentials file checked
+// before use, see
+// https://cloud.google.com/iam/docs/workload-identity-federation-with-other-clouds#create-cred-config
+type wifConfig struct {
+	Type             string          `json:"type"`
+	Audience         string          `json:"audience"`
+	SubjectTokenType string          `json:"subject_token_type"`
+	TokenURL         string          `json:"token_url"`
+	CredentialSource json.RawMessage `json:"credential_source"`
+}
+
+// wifCredentials loads a Workload Identity Federation config and exchanges
+// a token right away, so a malformed config or a refused exchange fails at
+// startup rather than on the first request.
+func wifCredentials(ctx context.Context, path string) (*google.Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("wif config: %w", err)
+	}
+
+	var cfg wifConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("wif config %s is not valid json: %w", path, err)
+	}
+	var missing []error
+	if cfg.Type != "external_account" {
+		missing = append(missing, fmt.Errorf("type is %q, expected external_account", cfg.Type))
+	}
+	for _, f := range []struct{ name, value string }{
+		{"audience", cfg.Audience},
+		{"subject_token_type", cfg.SubjectTokenType},
+		{"token_url", cfg.TokenURL},
+	} {
+		if f.value == "" {
+			missing = append(missing, fmt.Errorf("%s is missing", f.name))
+		}
+	}
+	if len(cfg.CredentialSource) == 0 {
+		missing = append(missing, errors.New("credential_source is missing"))
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("wif config %s: %w", path, errors.Join(missing...))
+	}
+
+	creds, err := google.CredentialsFromJSON(ctx, data, storage.ScopeFullControl)
+	if err != nil {
+		return nil, fmt.Errorf("wif config %s: %w", path, err)
+	}
+	if _, err := creds.TokenSource.Token(); err != nil {
+		return nil, fmt.Errorf("wif token exchange for audience %s failed: %w", cfg.Audience, err)
+	}
+	return creds, nil
+}
+
+// newStorageClient creates a storage client for the given identity. The
+// credentials file or WIF config, if any, is used as the base identity for
+// impersonation.
+func newStorageClient(ctx context.Context, o ClientOptions) (*storage.Client, error) {
+	var opts []option.ClientOption
+	switch {
+	case o.CredentialsFile != "" && o.WIFConfig != "":
+		return nil, errors.New("credentials file and wif config are mutually exclusive")
+	case o.CredentialsFile != "":
+		opts = append(opts, option.WithCredentialsFile(o.CredentialsFile))
+	case o.WIFConfig != "":
+		creds, err := wifCredentials(ctx, o.WIFConfig)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithCredentials(creds))
+	}
+
+	if o.ImpersonateSA != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: o.ImpersonateSA,
+			Scopes:          []string{storage.ScopeFullControl},
+		}, opts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = []option.ClientOption{option.WithTokenSource(ts)}
+	}
+
+	return storage.NewClient(ctx, opts...)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// -dst-date-field values, the object time partitioning the dst names
+const (
+	dateUpdated = "updated"
+	dateCreated = "created"
+	dateCustom  = "custom-time"
+)
+
+// dateFields maps a -dst-date-field value to the object attr it reads.
+var dateFields = map[string]string{
+	dateUpdated: "Updated",
+	dateCreated: "Created",
+	dateCustom:  "CustomTime",
+}
+
+// validateDatePrefix checks -dst-date-field. gc -gc-check dst only has the
+// row name to locate the copy, not the object time.
+func (svc *ImgDeduper) validateDatePrefix() error {
+	if !svc.DatePrefix {
+		return nil
+	}
+	if _, ok := dateFields[svc.DateField]; !ok {
+		return fmt.Errorf("unknown dst date field %q, expected %s, %s or %s", svc.DateField, dateUpdated, dateCreated, dateCustom)
+	}
+	if svc.Mode == modeGC && svc.GCCheck == gcCheckDst {
+		return errors.New("gc -gc-check dst can't locate copies named by -dst-prefix-by-date")
+	}
+	return nil
+}
+
+// objectDate returns the -dst-date-field time of attrs.
+func (svc *ImgDeduper) objectDate(attrs *storage.ObjectAttrs) time.Time {
+	switch svc.DateField {
+	case dateCreated:
+		return attrs.Created
+	case dateCustom:
+		return attrs.CustomTime
+	}
+	return attrs.Updated
+}
+
+// datedPrefix returns prefix followed by the YYYY/MM/DD of the object time
+// in UTC with -dst-prefix-by-date, prefix otherwise. An object without the
+// time fails, it would otherwise land in 0001/01/01.
+func (svc *ImgDeduper) datedPrefix(prefix string, attrs *storage.ObjectAttrs) (string, error) {
+	if !svc.DatePrefix {
+		return prefix, nil
+	}
+	t := svc.objectDate(attrs)
+	if t.IsZero() {
+		return "", fmt.Errorf("object %q has no %s time to date its destination", attrs.Name, svc.DateField)
+	}
+	return path.Join(strings.Trim(prefix, "/"), t.UTC().Format("2006/01/02")), nil
+}
+
+// dstNeedsAttrs reports whether the dst name of an object depends on attrs
+// besides its name, so callers holding only the name look them up first.
+func (svc *ImgDeduper) dstNeedsAttrs() bool {
+	return len(svc.routes) > 0 || svc.DatePrefix
+}
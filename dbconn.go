@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// pinnedConn is a pool connection a worker holds for its lifetime with
+// -db-pin-conns, saving the acquire and release of every transaction. It is
+// acquired on first use and again when it broke. Not safe for concurrent use,
+// a worker runs one transaction at a time.
+type pinnedConn struct {
+	pool *pgxpool.Pool
+	conn *pgxpool.Conn
+}
+
+func (p *pinnedConn) Begin(ctx context.Context) (pgx.Tx, error) {
+	return p.BeginTx(ctx, pgx.TxOptions{})
+}
+
+func (p *pinnedConn) BeginTx(ctx context.Context, opts pgx.TxOptions) (pgx.Tx, error) {
+	if p.conn != nil && p.conn.Conn().IsClosed() {
+		p.release()
+	}
+	if p.conn == nil {
+		c, err := p.pool.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		p.conn = c
+	}
+	return p.conn.BeginTx(ctx, opts)
+}
+
+// release returns the connection to the pool.
+func (p *pinnedConn) release() {
+	if p.conn != nil {
+		p.conn.Release()
+		p.conn = nil
+	}
+}
+
+type ctxConn struct{}
+
+// contextWithConn makes the transactions run with ctx use c, a nil c
+// acquires one per transaction again.
+func contextWithConn(ctx context.Context, c *pinnedConn) context.Context {
+	return context.WithValue(ctx, ctxConn{}, c)
+}
+
+// txConn returns the connection pinned to ctx, or roach to acquire one per
+// transaction.
+func txConn(ctx context.Context, roach *pgxpool.Pool) crdbpgx.Conn {
+	if c, ok := ctx.Value(ctxConn{}).(*pinnedConn); ok && c != nil {
+		return c
+	}
+	return roach
+}
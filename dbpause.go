@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// database probe backoff while a scan is paused by -drain-on-db-error
+const (
+	dbProbeDelay    = time.Second
+	dbProbeMaxDelay = 30 * time.Second
+	dbProbeTimeout  = 5 * time.Second
+)
+
+// dbPause holds a scan while the database is unreachable. The first worker
+// an outage fails probes the database with a backoff, the other failed
+// workers and the lister wait for it to answer. A nil dbPause never pauses.
+type dbPause struct {
+	ping   func(context.Context) error
+	gauge  prometheus.Gauge
+	pauses prometheus.Counter
+
+	mu sync.Mutex
+	// resumed is closed once the database answers again, nil while it
+	// isn't paused
+	resumed chan struct{}
+	since   time.Time
+}
+
+func newDBPause(enabled bool, ping func(context.Context) error, m *metrics) *dbPause {
+	if !enabled {
+		return nil
+	}
+	return &dbPause{ping: ping, gauge: m.dbPaused, pauses: m.dbPauses}
+}
+
+// dbOutage reports whether err, a database failure of the object ctx is
+// processing, pauses the scan instead of failing the object.
+func (svc *ImgDeduper) dbOutage(ctx context.Context, err error) bool {
+	return svc.pause != nil && ctx.Err() == nil && isConnError(err)
+}
+
+// paused returns since when the scan is paused, zero when it isn't.
+func (p *dbPause) paused() time.Time {
+	if p == nil {
+		return time.Time{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed == nil {
+		return time.Time{}
+	}
+	return p.since
+}
+
+// wait blocks while the scan is paused or ctx is done.
+func (p *dbPause) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	ch := p.resumed
+	p.mu.Unlock()
+	if ch == nil {
+		return nil
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// await pauses the scan after err, a database connection failure, and
+// returns once the database answers again, or with ctx's error. A worker
+// finding the scan paused already waits for the probing one.
+func (p *dbPause) await(ctx context.Context, err error) error {
+	l := loggerFromContext(ctx)
+
+	p.mu.Lock()
+	if ch := p.resumed; ch != nil {
+		p.mu.Unlock()
+		return p.wait(ctx)
+	}
+	ch := make(chan struct{})
+	p.resumed, p.since = ch, time.Now()
+	p.gauge.Set(1)
+	p.pauses.Inc()
+	p.mu.Unlock()
+	level.Warn(l).Log("msg", "database unavailable, pausing the scan", "error", err)
+
+	perr := p.probe(ctx)
+
+	p.mu.Lock()
+	paused := time.Since(p.since)
+	p.resumed = nil
+	p.gauge.Set(0)
+	close(ch)
+	p.mu.Unlock()
+	if perr != nil {
+		return perr
+	}
+	level.Info(l).Log("msg", "database available, resuming the scan", "paused", paused.Round(time.Second))
+	return nil
+}
+
+// probe pings the database with an exponential backoff until it answers.
+func (p *dbPause) probe(ctx context.Context) error {
+	delay := dbProbeDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		pctx, cancel := context.WithTimeout(ctx, dbProbeTimeout)
+		err := p.ping(pctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		level.Debug(loggerFromContext(ctx)).Log("msg", "database still unavailable", "attempt", attempt, "error", err)
+		if delay *= 2; delay > dbProbeMaxDelay {
+			delay = dbProbeMaxDelay
+		}
+	}
+}
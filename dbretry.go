@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const connRetryDelay = 200 * time.Millisecond
+
+type connRetriesKey struct{}
+
+// withConnRetries configures ctx so that db operations are retried up to
+// retries times on connection failures, on top of the serialization retries
+// crdbpgx performs within a transaction.
+func withConnRetries(ctx context.Context, retries int) context.Context {
+	return context.WithValue(ctx, connRetriesKey{}, retries)
+}
+
+func connRetriesFromContext(ctx context.Context) int {
+	if retries, ok := ctx.Value(connRetriesKey{}).(int); ok && retries > 0 {
+		return retries
+	}
+	return 0
+}
+
+// isConnError reports whether err is a connection level failure, e.g. a node
+// restarting during a rolling upgrade, rather than a statement error.
+func isConnError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// class 08 connection exception, 57P01 admin shutdown
+		return strings.HasPrefix(pgErr.Code, "08") || pgErr.Code == "57P01"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		pgconn.SafeToRetry(err)
+}
+
+// retryConn runs fn, retrying it with a linear backoff while it fails with a
+// connection error. The pool discards broken connections, so each attempt
+// runs on a fresh one. While the database breaker of ctx is open it waits
+// instead, and once the retries are exhausted the failure counts towards it.
+func retryConn(ctx context.Context, operation string, fn func() error) error {
+	b := breakerFromContext(ctx)
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	retries := connRetriesFromContext(ctx)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > retries || !isConnError(err) || ctx.Err() != nil {
+			b.record(ctx, err)
+			return err
+		}
+
+		metricsFromContext(ctx).dbConnRetries.With(prometheus.Labels{"operation": operation}).Inc()
+		level.Warn(loggerFromContext(ctx)).Log("msg", "database connection failed, retrying", "operation", operation, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * connRetryDelay):
+		}
+	}
+}
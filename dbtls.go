@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ssl modes of -db-ssl-mode, as in libpq
+const (
+	sslDisable    = "disable"
+	sslRequire    = "require"
+	sslVerifyCA   = "verify-ca"
+	sslVerifyFull = "verify-full"
+)
+
+// validateDBTLS checks the TLS flags are consistent and their files exist.
+func validateDBTLS(o DBOptions) error {
+	switch o.SSLMode {
+	case "":
+		if o.SSLRootCert != "" || o.SSLCert != "" || o.SSLKey != "" {
+			return errors.New("db ssl cert flags require -db-ssl-mode")
+		}
+		return nil
+	case sslDisable, sslRequire, sslVerifyCA, sslVerifyFull:
+	default:
+		return fmt.Errorf("unknown db ssl mode %q, expected %s, %s, %s or %s", o.SSLMode, sslDisable, sslRequire, sslVerifyCA, sslVerifyFull)
+	}
+	if (o.SSLCert == "") != (o.SSLKey == "") {
+		return errors.New("-db-ssl-cert and -db-ssl-key must be set together")
+	}
+	if o.SSLMode == sslVerifyCA && o.SSLRootCert == "" {
+		return fmt.Errorf("db ssl mode %s requires -db-ssl-root-cert", sslVerifyCA)
+	}
+	for _, path := range []string{o.SSLRootCert, o.SSLCert, o.SSLKey} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("db ssl: %w", err)
+		}
+	}
+	return nil
+}
+
+// applyDBTLS replaces the TLS settings parsed from the connection string with
+// the -db-ssl-* flags. Without -db-ssl-mode the connection string decides.
+func applyDBTLS(cfg *pgconn.Config, o DBOptions) error {
+	if o.SSLMode == "" {
+		return nil
+	}
+	tlsConfig, err := dbTLSConfig(o, cfg.Host)
+	if err != nil {
+		return err
+	}
+	cfg.TLSConfig = tlsConfig
+	// the fallbacks carry the TLS settings of the connection string, e.g. a
+	// plaintext retry for sslmode=prefer
+	cfg.Fallbacks = nil
+	return nil
+}
+
+// dbTLSConfig builds the client TLS config of the ssl mode, nil for disable.
+// require only encrypts, unless a root cert is given which makes it verify
+// the chain like verify-ca. verify-full also checks the host name.
+func dbTLSConfig(o DBOptions, host string) (*tls.Config, error) {
+	if o.SSLMode == sslDisable {
+		return nil, nil
+	}
+
+	c := &tls.Config{ServerName: host}
+	if o.SSLRootCert != "" {
+		pem, err := os.ReadFile(o.SSLRootCert)
+		if err != nil {
+			return nil, fmt.Errorf("db ssl root cert: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("db ssl root cert %s: no certificates found", o.SSLRootCert)
+		}
+	}
+	if o.SSLCert != "" {
+		cert, err := tls.LoadX509KeyPair(o.SSLCert, o.SSLKey)
+		if err != nil {
+			return nil, fmt.Errorf("db ssl client cert: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	switch {
+	case o.SSLMode == sslVerifyFull:
+	case o.SSLMode == sslRequire && o.SSLRootCert == "":
+		c.InsecureSkipVerify = true
+	default:
+		// verify the chain but not the host name, the default verification
+		// can't do one without the other
+		c.InsecureSkipVerify = true
+		c.VerifyPeerCertificate = verifyChain(c.RootCAs)
+	}
+	return c, nil
+}
+
+// verifyChain verifies the server certificate chain against roots, ignoring
+// the host name.
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		var leaf *x509.Certificate
+		for i, b := range raw {
+			cert, err := x509.ParseCertificate(b)
+			if err != nil {
+				return fmt.Errorf("parse server certificate: %w", err)
+			}
+			if i == 0 {
+				leaf = cert
+			} else {
+				opts.Intermediates.AddCert(cert)
+			}
+		}
+		_, err := leaf.Verify(opts)
+		return err
+	}
+}
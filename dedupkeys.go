@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// dedupKeyHash matches on the hash of -hash-strategy, the default key.
+const dedupKeyHash = "hash"
+
+// dedupColumns are the images columns -dedup-keys may match on, with the
+// value insertImage stores in each for an object. Only these names are ever
+// put in a query.
+var dedupColumns = map[string]func(attrs *storage.ObjectAttrs, section, key string) any{
+	dedupKeyHash:       func(_ *storage.ObjectAttrs, _, key string) any { return key },
+	"crc32":            func(a *storage.ObjectAttrs, _, _ string) any { return int64(a.CRC32C) },
+	"size":             func(a *storage.ObjectAttrs, _, _ string) any { return a.Size },
+	"content_encoding": func(a *storage.ObjectAttrs, _, _ string) any { return a.ContentEncoding },
+	"section":          func(_ *storage.ObjectAttrs, section, _ string) any { return section },
+	"prefix":           func(a *storage.ObjectAttrs, _, _ string) any { return filepath.Dir(a.Name) },
+	"bucket":           func(a *storage.ObjectAttrs, _, _ string) any { return a.Bucket },
+}
+
+// validateDedupKeys checks every -dedup-keys column is allowlisted and
+// listed once.
+func validateDedupKeys(keys []string) error {
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if _, ok := dedupColumns[k]; !ok {
+			names := make([]string, 0, len(dedupColumns))
+			for name := range dedupColumns {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown dedup key %q, expected one of %s", k, strings.Join(names, ", "))
+		}
+		if seen[k] {
+			return fmt.Errorf("dedup key %q listed twice", k)
+		}
+		seen[k] = true
+	}
+	return nil
+}
+
+// dedupMatch is the condition matching the stored images an object
+// duplicates. where uses the placeholders $1 to $len(args), queries number
+// their own parameters after them. key identifies the match within a run.
+type dedupMatch struct {
+	where string
+	args  []any
+	key   string
+}
+
+// dedupMatch builds the match of an object from -dedup-keys, by default its
+// hash under -hash-strategy. Matching on the hash also matches the strategy,
+// keys of different strategies never match.
+func (svc *ImgDeduper) dedupMatch(attrs *storage.ObjectAttrs, section, key string) dedupMatch {
+	cols := svc.DedupKeys
+	if len(cols) == 0 {
+		cols = []string{dedupKeyHash}
+	}
+
+	var conds []string
+	var args []any
+	for _, col := range cols {
+		if col == dedupKeyHash {
+			args = append(args, svc.HashStrategy)
+			conds = append(conds, fmt.Sprintf("hash_strategy = $%d", len(args)))
+		}
+		args = append(args, dedupColumns[col](attrs, section, key))
+		conds = append(conds, fmt.Sprintf("%s = $%d", col, len(args)))
+	}
+
+	m := dedupMatch{where: strings.Join(conds, " AND "), args: args, key: key}
+	if len(svc.DedupKeys) > 0 {
+		vals := make([]string, len(args))
+		for i, a := range args {
+			vals[i] = fmt.Sprint(a)
+		}
+		m.key = strings.Join(vals, "/")
+	}
+	return m
+}
+
+// param returns the placeholder of the i-th query parameter after the match
+// args, counting from 1.
+func (m dedupMatch) param(i int) string {
+	return fmt.Sprintf("$%d", len(m.args)+i)
+}
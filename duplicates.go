@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+)
+
+// duplicateOfKey is the custom metadata key set on tagged duplicates.
+const duplicateOfKey = "duplicate-of"
+
+// tagDuplicate marks the src object as a duplicate of original, leaving it in
+// place for a later cleanup. An in-run duplicate whose original isn't
+// committed yet is left untagged and picked up by the next run.
+func (svc *ImgDeduper) tagDuplicate(ctx context.Context, obj *storage.ObjectHandle, attrs *storage.ObjectAttrs, original string) error {
+	ctx, span := tracer.Start(ctx, "gcs.tag")
+	defer span.End()
+
+	if original == "" || original == attrs.Name {
+		level.Debug(loggerFromContext(ctx)).Log("msg", "original not stored yet, not tagging", "name", attrs.Name)
+		return nil
+	}
+	if attrs.Metadata[duplicateOfKey] == original {
+		return nil
+	}
+
+	// only update the generation that was checked, metadata merges with existing keys
+	_, err := obj.If(storage.Conditions{MetagenerationMatch: attrs.Metageneration}).Update(ctx, storage.ObjectAttrsToUpdate{
+		Metadata: map[string]string{duplicateOfKey: original},
+	})
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+)
+
+// Failure classes. Underlying errors are wrapped with one of these, e.g.
+// fmt.Errorf("%w: %w", ErrInsert, err), so failures can be classified with
+// errors.Is.
+var (
+	ErrListing  = errors.New("listing")
+	ErrValidate = errors.New("validate")
+	ErrHash     = errors.New("hash")
+	ErrExif     = errors.New("exif")
+	ErrCount    = errors.New("count")
+	ErrInsert   = errors.New("insert")
+	ErrCopy     = errors.New("copy")
+	ErrDelete   = errors.New("delete")
+	ErrTag      = errors.New("tag")
+	ErrTimeout  = errors.New("timeout")
+	// ErrCRCMismatch marks a copy whose crc32c differs from the source,
+	// classed ErrCopy as well
+	ErrCRCMismatch = errors.New("crc32c mismatch")
+)
+
+// errorClasses are matched in order, the first match names the class.
+var errorClasses = []error{ErrTimeout, ErrListing, ErrValidate, ErrHash, ErrExif, ErrCount, ErrInsert, ErrCopy, ErrDelete, ErrTag}
+
+// errorClass names the failure class of err, "other" when it has none.
+func errorClass(err error) string {
+	for _, class := range errorClasses {
+		if errors.Is(err, class) {
+			return class.Error()
+		}
+	}
+	return "other"
+}
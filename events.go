@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// subscriberBuffer is the number of events a subscriber may lag behind before
+// it is dropped.
+const subscriberBuffer = 64
+
+// ObjectEvent describes the outcome of a processed object.
+type ObjectEvent struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	CRC32  uint32 `json:"crc32"`
+	Size   int64  `json:"size"`
+	// Original is the stored image this object duplicates, if any.
+	Original string `json:"original,omitempty"`
+}
+
+// EventSink receives the event of every processed object. Emit is called
+// concurrently by the workers and must not block on slow backends. Close is
+// called once every object is processed and flushes anything buffered.
+type EventSink interface {
+	Emit(ev ObjectEvent) error
+	Close(ctx context.Context) error
+}
+
+// emit hands ev to every sink, a failing sink never fails the object.
+func (svc *ImgDeduper) emit(ev ObjectEvent) {
+	for _, sink := range svc.sinks {
+		if err := sink.Emit(ev); err != nil {
+			level.Error(svc.errLog).Log("msg", "failed to emit object event", "sink", fmt.Sprintf("%T", sink), "name", ev.Name, "error", err)
+		}
+	}
+}
+
+// closeSinks flushes the sinks. The service context may already be cancelled
+// on shutdown, so the final flush gets its own deadline.
+func (svc *ImgDeduper) closeSinks() {
+	l := loggerFromContext(svc.Context)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for _, sink := range svc.sinks {
+		if err := sink.Close(ctx); err != nil {
+			level.Error(l).Log("msg", "failed to close event sink", "sink", fmt.Sprintf("%T", sink), "error", err)
+		}
+	}
+}
+
+// broadcaster fans object events out to subscribers. Publishing never blocks,
+// a subscriber whose buffer is full is dropped instead.
+type broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan ObjectEvent]struct{}
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subs: make(map[chan ObjectEvent]struct{})}
+}
+
+// subscribe registers a subscriber. The returned func unsubscribes it and
+// must be called once the subscriber is done.
+func (b *broadcaster) subscribe() (<-chan ObjectEvent, func()) {
+	ch := make(chan ObjectEvent, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() { b.drop(ch) }
+}
+
+// publish sends ev to every subscriber, dropping the slow ones.
+func (b *broadcaster) publish(ev ObjectEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Emit publishes ev to the subscribers.
+func (b *broadcaster) Emit(ev ObjectEvent) error {
+	b.publish(ev)
+	return nil
+}
+
+// Close leaves the subscribers connected, the stream outlives the run.
+func (b *broadcaster) Close(context.Context) error {
+	return nil
+}
+
+// drop removes and closes a subscriber if it is still registered.
+func (b *broadcaster) drop(ch chan ObjectEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
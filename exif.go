@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// exifHeaderSize is the prefix of an object read with -extract-exif. The EXIF
+// segment is a single APP1 segment of at most 64KiB near the start of the
+// file, the rest leaves room for the segments before it.
+const exifHeaderSize = 128 << 10
+
+// exifTimeLayout is the layout of the EXIF date tags, without a time zone.
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// EXIF tags read, see https://www.cipa.jp/std/documents/e/DC-008-2012_E.pdf
+const (
+	tagModel            = 0x0110
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+)
+
+// TIFF field types read
+const (
+	typeASCII    = 2
+	typeLong     = 4
+	typeRational = 5
+)
+
+// exifData are the EXIF fields stored with an image. Zero fields are stored
+// as NULL.
+type exifData struct {
+	TakenAt time.Time
+	Model   string
+	Lat     float64
+	Lon     float64
+	HasGPS  bool
+}
+
+// readHeader reads up to n bytes from the start of the object.
+func (svc *ImgDeduper) readHeader(ctx context.Context, obj *storage.ObjectHandle, name string, n int64) ([]byte, error) {
+	var r io.ReadCloser
+	if svc.SrcURL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, svc.srcURL(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return nil, fmt.Errorf("get: %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		var err error
+		if r, err = obj.NewRangeReader(ctx, 0, n); err != nil {
+			return nil, err
+		}
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, n))
+}
+
+// extractExif reads the object header and parses its EXIF. A read failure is
+// returned as err. An image without EXIF, or with EXIF that doesn't parse,
+// returns nil data and no error, its fields are left NULL.
+func (svc *ImgDeduper) extractExif(ctx context.Context, obj *storage.ObjectHandle, name string) (*exifData, error) {
+	ctx, span := tracer.Start(ctx, "exif")
+	defer span.End()
+
+	b, err := svc.readHeader(ctx, obj, name, exifHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	tiff := jpegExif(b)
+	if tiff == nil {
+		return nil, nil
+	}
+	d, err := parseExif(tiff)
+	if err != nil {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// jpegExif returns the TIFF structure of the EXIF APP1 segment of a JPEG, nil
+// when there is none before the image data or the segment is truncated.
+func jpegExif(b []byte) []byte {
+	if len(b) < 2 || b[0] != 0xFF || b[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return nil
+		}
+		marker := b[i+1]
+		// fill bytes before a marker
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		// start of scan or end of image, no metadata follows
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(b[i+2:]))
+		start, end := i+4, i+2+size
+		if size < 2 || end > len(b) {
+			return nil
+		}
+		if marker == 0xE1 && bytes.HasPrefix(b[start:end], []byte("Exif\x00\x00")) {
+			return b[start+6 : end]
+		}
+		i = end
+	}
+	return nil
+}
+
+// tiffReader reads the IFDs of a TIFF structure, every read bounds checked.
+type tiffReader struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+var errExifTruncated = errors.New("exif truncated")
+
+// ifdEntry is a field of an IFD.
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	// value is the 4 byte value field, the value itself when it fits and
+	// the offset of the value otherwise
+	value []byte
+}
+
+func (t *tiffReader) u16(off uint32) (uint16, error) {
+	if uint64(off)+2 > uint64(len(t.b)) {
+		return 0, errExifTruncated
+	}
+	return t.order.Uint16(t.b[off:]), nil
+}
+
+func (t *tiffReader) u32(off uint32) (uint32, error) {
+	if uint64(off)+4 > uint64(len(t.b)) {
+		return 0, errExifTruncated
+	}
+	return t.order.Uint32(t.b[off:]), nil
+}
+
+// ifd returns the entries of the IFD at off by tag.
+func (t *tiffReader) ifd(off uint32) (map[uint16]ifdEntry, error) {
+	n, err := t.u16(off)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[uint16]ifdEntry, n)
+	for i := uint32(0); i < uint32(n); i++ {
+		e := off + 2 + 12*i
+		if uint64(e)+12 > uint64(len(t.b)) {
+			return nil, errExifTruncated
+		}
+		tag := t.order.Uint16(t.b[e:])
+		entries[tag] = ifdEntry{
+			typ:   t.order.Uint16(t.b[e+2:]),
+			count: t.order.Uint32(t.b[e+4:]),
+			value: t.b[e+8 : e+12],
+		}
+	}
+	return entries, nil
+}
+
+// data returns the value bytes of e, size bytes per value.
+func (t *tiffReader) data(e ifdEntry, size uint32) ([]byte, error) {
+	n := uint64(e.count) * uint64(size)
+	if n <= 4 {
+		return e.value[:n], nil
+	}
+	off := uint64(t.order.Uint32(e.value))
+	if off+n > uint64(len(t.b)) {
+		return nil, errExifTruncated
+	}
+	return t.b[off : off+n], nil
+}
+
+// ascii returns an ASCII field without its NUL terminator and padding.
+func (t *tiffReader) ascii(e ifdEntry) (string, error) {
+	if e.typ != typeASCII {
+		return "", fmt.Errorf("exif field type %d, expected ASCII", e.typ)
+	}
+	b, err := t.data(e, 1)
+	if err != nil {
+		return "", err
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// offset returns the IFD offset of a pointer field.
+func (t *tiffReader) offset(e ifdEntry) (uint32, error) {
+	if e.typ != typeLong || e.count != 1 {
+		return 0, fmt.Errorf("exif pointer type %d, expected LONG", e.typ)
+	}
+	return t.order.Uint32(e.value), nil
+}
+
+// degrees converts a GPS coordinate of three rationals, degrees minutes and
+// seconds, to decimal degrees.
+func (t *tiffReader) degrees(e ifdEntry) (float64, error) {
+	if e.typ != typeRational || e.count != 3 {
+		return 0, fmt.Errorf("exif gps type %d, expected 3 RATIONAL", e.typ)
+	}
+	b, err := t.data(e, 8)
+	if err != nil {
+		return 0, err
+	}
+	var v float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num := t.order.Uint32(b[8*i:])
+		den := t.order.Uint32(b[8*i+4:])
+		if den == 0 {
+			return 0, errors.New("exif gps rational with zero denominator")
+		}
+		v += float64(num) / float64(den) / unit
+	}
+	return v, nil
+}
+
+// parseExif reads the capture time and camera model of IFD0 and the Exif IFD,
+// and the coordinates of the GPS IFD. Fields that are missing or malformed are
+// left zero, only a malformed header or IFD0 fails the parse.
+func parseExif(b []byte) (*exifData, error) {
+	if len(b) < 8 {
+		return nil, errExifTruncated
+	}
+	t := &tiffReader{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("exif byte order unknown")
+	}
+	if t.order.Uint16(b[2:]) != 42 {
+		return nil, errors.New("exif tiff magic missing")
+	}
+	ifd0, err := t.ifd(t.order.Uint32(b[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &exifData{}
+	if e, ok := ifd0[tagModel]; ok {
+		d.Model, _ = t.ascii(e)
+	}
+	// DateTime is the last change, only used without DateTimeOriginal
+	taken := ""
+	if e, ok := ifd0[tagDateTime]; ok {
+		taken, _ = t.ascii(e)
+	}
+	if e, ok := ifd0[tagExifIFD]; ok {
+		if off, err := t.offset(e); err == nil {
+			if exif, err := t.ifd(off); err == nil {
+				if e, ok := exif[tagDateTimeOriginal]; ok {
+					if s, err := t.ascii(e); err == nil && s != "" {
+						taken = s
+					}
+				}
+			}
+		}
+	}
+	// unknown dates are stored as blanks or zeros
+	if ts, err := time.Parse(exifTimeLayout, taken); err == nil {
+		d.TakenAt = ts
+	}
+
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		if off, err := t.offset(e); err == nil {
+			if gps, err := t.ifd(off); err == nil {
+				d.Lat, d.Lon, d.HasGPS = t.coordinates(gps)
+			}
+		}
+	}
+	return d, nil
+}
+
+// coordinates returns the signed latitude and longitude of a GPS IFD.
+func (t *tiffReader) coordinates(gps map[uint16]ifdEntry) (float64, float64, bool) {
+	lat, err := t.degrees(gps[tagGPSLatitude])
+	if err != nil {
+		return 0, 0, false
+	}
+	lon, err := t.degrees(gps[tagGPSLongitude])
+	if err != nil {
+		return 0, 0, false
+	}
+	if ref, _ := t.ascii(gps[tagGPSLatitudeRef]); ref == "S" {
+		lat = -lat
+	}
+	if ref, _ := t.ascii(gps[tagGPSLongitudeRef]); ref == "W" {
+		lon = -lon
+	}
+	if math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// updateExif stores the EXIF fields of the image name, zero fields as NULL.
+func updateExif(ctx context.Context, roach *pgxpool.Pool, name string, d *exifData) error {
+	ctx, span := tracer.Start(ctx, "db.exif")
+	defer span.End()
+
+	var takenAt, model, lat, lon any
+	if !d.TakenAt.IsZero() {
+		takenAt = d.TakenAt
+	}
+	if d.Model != "" {
+		model = d.Model
+	}
+	if d.HasGPS {
+		lat, lon = d.Lat, d.Lon
+	}
+	return retryConn(ctx, "exif", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "UPDATE images SET exif_taken_at = $2, exif_model = $3, exif_lat = $4, exif_lon = $5 WHERE name = $1",
+				name, takenAt, model, lat, lon)
+			return err
+		})
+	})
+}
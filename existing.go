@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// existingAction is what -skip-existing does with an object.
+type existingAction int
+
+const (
+	// existingProcess processes the object as usual, its dst copy is missing
+	existingProcess existingAction = iota
+	// existingSkip leaves the object alone, its row and dst copy are stored
+	existingSkip
+	// existingRepair only inserts the row of an object already copied to dst
+	existingRepair
+)
+
+// skipExistingAction decides what to do with an object from whether its row
+// and its dst copy exist. A missing copy is made as usual whether or not the
+// row exists, the insert keeps an existing row.
+func skipExistingAction(rowExists, dstExists bool) existingAction {
+	switch {
+	case !dstExists:
+		return existingProcess
+	case rowExists:
+		return existingSkip
+	default:
+		return existingRepair
+	}
+}
+
+// imageExists reports whether the images table has a row for name.
+func imageExists(ctx context.Context, roach *pgxpool.Pool, name string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "db.exists")
+	defer span.End()
+
+	exists := false
+	err := retryConn(ctx, "exists", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			return tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM images WHERE name = $1)", name).Scan(&exists)
+		})
+	})
+	return exists, err
+}
+
+// existingState looks up whether dstName exists in dst and, only when it
+// does, whether the row of name exists. Errors are classed ErrCopy and
+// ErrCount.
+func (svc *ImgDeduper) existingState(ctx context.Context, dst *storage.BucketHandle, dstName, name string) (existingAction, error) {
+	_, err := dst.Object(dstName).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return skipExistingAction(false, false), nil
+	}
+	if err != nil {
+		return existingProcess, fmt.Errorf("%w: dst attrs: %w", ErrCopy, err)
+	}
+	rowExists, err := imageExists(ctx, svc.Roach, name)
+	if err != nil {
+		return existingProcess, fmt.Errorf("%w: %w", ErrCount, err)
+	}
+	return skipExistingAction(rowExists, true), nil
+}
+
+// repairRow inserts the row of an object whose dst copy is already stored and
+// marks it copied, without copying the object again.
+func (svc *ImgDeduper) repairRow(ctx context.Context, src *storage.BucketHandle, attrs *storage.ObjectAttrs, section string) error {
+	key, err := svc.Hasher.Key(ctx, attrs, src.Object(attrs.Name))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrHash, err)
+	}
+	// later objects of this run with the same key are duplicates
+	svc.seen.claim(svc.dedupMatch(attrs, section, key).key)
+
+	if err := insertImage(ctx, svc.Roach, attrs, section, svc.HashStrategy, key, svc.RunID); err != nil {
+		return fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	if err := markCopied(ctx, svc.Roach, attrs.Name, svc.staging()); err != nil {
+		return fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	return nil
+}
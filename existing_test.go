@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestSkipExistingAction(t *testing.T) {
+	tests := []struct {
+		name      string
+		rowExists bool
+		dstExists bool
+		want      existingAction
+	}{
+		{"row and dst copy", true, true, existingSkip},
+		{"dst copy without row", false, true, existingRepair},
+		{"row without dst copy", true, false, existingProcess},
+		{"neither", false, false, existingProcess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := skipExistingAction(tt.rowExists, tt.dstExists); got != tt.want {
+				t.Errorf("skipExistingAction(%v, %v) = %v, want %v", tt.rowExists, tt.dstExists, got, tt.want)
+			}
+		})
+	}
+}
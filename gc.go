@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/go-kit/log/level"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// gc check targets
+const (
+	gcCheckSrc = "src"
+	gcCheckDst = "dst"
+)
+
+// gcBatchSize is the number of rows checked, and stale ones deleted, at once.
+const gcBatchSize = 1000
+
+// getImageNames returns up to limit names of bucket's rows sorted after
+// after. With copied only rows whose copy was stored under its final name
+// are returned, rows stamped with the epoch before copies were tracked and
+// staged copies not yet promoted are left out. Rows stored before the bucket
+// was recorded may belong to any src, they are only returned with nullBucket.
+func getImageNames(ctx context.Context, roach *pgxpool.Pool, bucket, after string, copied, nullBucket bool, limit int) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "db.names")
+	defer span.End()
+
+	var names []string
+	err := retryConn(ctx, "names", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			names = names[:0]
+			rows, err := tx.Query(ctx, `SELECT name FROM images
+				WHERE (bucket = $1 OR ($5 AND bucket IS NULL)) AND name > $2
+				AND (NOT $3 OR (copied_at > '1970-01-01 00:00:00+00' AND (staged_at IS NULL OR promoted_at IS NOT NULL)))
+				ORDER BY name LIMIT $4`, bucket, after, copied, limit, nullBucket)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var name string
+				if err := rows.Scan(&name); err != nil {
+					return err
+				}
+				names = append(names, name)
+			}
+			return rows.Err()
+		})
+	})
+	return names, err
+}
+
+// deleteImages deletes the rows of names and returns how many were deleted.
+func deleteImages(ctx context.Context, roach *pgxpool.Pool, names []string) (int64, error) {
+	ctx, span := tracer.Start(ctx, "db.delete_batch")
+	defer span.End()
+
+	var n int64
+	err := retryConn(ctx, "delete_batch", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			tag, err := tx.Exec(ctx, "DELETE FROM images WHERE name = ANY($1)", names)
+			n = tag.RowsAffected()
+			return err
+		})
+	})
+	return n, err
+}
+
+// gc deletes the rows of the src bucket whose object no longer exists. With
+// -gc-check src the src object is checked. With dst the dst copy of copied
+// rows is checked, duplicates have no copy of their own. Rows are checked a
+// batch at a time on svc.Workers goroutines and the stale ones of each batch
+// deleted together.
+func (svc *ImgDeduper) gc(src, dst *storage.BucketHandle) error {
+	l := loggerFromContext(svc.Context)
+	if svc.GCCheck != gcCheckSrc && svc.GCCheck != gcCheckDst {
+		return fmt.Errorf("unknown gc check %q, expected %s or %s", svc.GCCheck, gcCheckSrc, gcCheckDst)
+	}
+	level.Info(l).Log("msg", "gc started", "check", svc.GCCheck, "bucket", svc.SrcBucketName, "workers", svc.Workers, "limit", svc.Limit)
+
+	var checked, pruned, errored int64
+	var err error
+	after := ""
+	for svc.Ready.Load() {
+		size := gcBatchSize
+		if svc.Limit > 0 {
+			if checked >= int64(svc.Limit) {
+				level.Info(l).Log("msg", "limit reached", "limit", svc.Limit)
+				break
+			}
+			if left := svc.Limit - int(checked); left < size {
+				size = left
+			}
+		}
+
+		var names []string
+		names, err = getImageNames(svc.Context, svc.Roach, svc.SrcBucketName, after, svc.GCCheck == gcCheckDst, svc.GCNullBucket, size)
+		if err != nil || len(names) == 0 {
+			break
+		}
+		after = names[len(names)-1]
+
+		// the other shards' replicas check the rest of the batch
+		if svc.ShardCount > 1 {
+			mine := names[:0]
+			for _, name := range names {
+				if svc.inShard(name) {
+					mine = append(mine, name)
+				}
+			}
+			names = mine
+		}
+		checked += int64(len(names))
+
+		stale, failed := svc.staleImages(src, dst, names)
+		errored += failed
+		if len(stale) == 0 {
+			continue
+		}
+		n, derr := deleteImages(svc.Context, svc.Roach, stale)
+		if derr != nil {
+			err = fmt.Errorf("%w: %w", ErrDelete, derr)
+			break
+		}
+		pruned += n
+		level.Info(l).Log("msg", "pruned stale rows", "rows", n, "after", after)
+	}
+
+	level.Info(l).Log("msg", "gc summary",
+		"checked", checked,
+		"pruned", pruned,
+		"error", errored)
+	if err != nil {
+		return err
+	}
+	if errored > 0 {
+		return fmt.Errorf("gc failed to check %d rows", errored)
+	}
+	return nil
+}
+
+// staleImages returns the names whose object is gone and the number of
+// names that couldn't be checked.
+func (svc *ImgDeduper) staleImages(src, dst *storage.BucketHandle, names []string) ([]string, int64) {
+	var mu sync.Mutex
+	var stale []string
+	var failed int64
+
+	workers := svc.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range jobs {
+				gone, err := svc.objectGone(src, dst, name)
+				mu.Lock()
+				switch {
+				case err != nil:
+					level.Error(svc.errLog).Log("msg", "failed to check object", "name", name, "check", svc.GCCheck, "error", err)
+					failed++
+				case gone:
+					level.Debug(loggerFromContext(svc.Context)).Log("msg", "stale row", "name", name, "check", svc.GCCheck)
+					stale = append(stale, name)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, name := range names {
+		jobs <- name
+	}
+	close(jobs)
+	wg.Wait()
+	return stale, failed
+}
+
+// objectGone reports whether the object of the row name no longer exists.
+func (svc *ImgDeduper) objectGone(src, dst *storage.BucketHandle, name string) (bool, error) {
+	var err error
+	if svc.GCCheck == gcCheckDst {
+		err = svc.checkCopy(src, dst, name)
+	} else {
+		_, err = svc.srcAttrs(svc.Context, src, name)
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return true, nil
+	}
+	return false, err
+}
+
+// checkCopy looks the dst copy of the row name up. With content type routes
+// the copy is located from the src attrs, a row whose src is gone as well
+// fails rather than passing for stale.
+func (svc *ImgDeduper) checkCopy(src, dst *storage.BucketHandle, name string) error {
+	attrs := &storage.ObjectAttrs{Name: name}
+	if len(svc.routes) > 0 {
+		var err error
+		if attrs, err = svc.srcAttrs(svc.Context, src, name); errors.Is(err, storage.ErrObjectNotExist) {
+			return errors.New("src object not found, can't route its copy")
+		} else if err != nil {
+			return fmt.Errorf("src attrs: %w", err)
+		}
+	}
+	route, dstName, err := svc.routeObject(dst, attrs)
+	if err != nil {
+		return err
+	}
+	_, err = route.Object(dstName).Attrs(svc.Context)
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// Hasher derives the dedup key of an object. obj is the source object handle
+// for strategies that need to read the object content.
+type Hasher interface {
+	Key(ctx context.Context, attrs *storage.ObjectAttrs, obj *storage.ObjectHandle) (string, error)
+}
+
+// hashers is the registry of dedup strategies selectable with -hash-strategy.
+var hashers = map[string]Hasher{
+	"crc32":     crc32Hasher{},
+	"crc32size": crc32SizeHasher{},
+	"md5":       md5Hasher{},
+	"sha256":    sha256Hasher{},
+}
+
+// newHasher looks up a dedup strategy by name. Every strategy keys the stored
+// bytes, see encodingHasher.
+func newHasher(name string) (Hasher, error) {
+	h, ok := hashers[name]
+	if !ok {
+		names := make([]string, 0, len(hashers))
+		for n := range hashers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown hash strategy %q, expected one of %v", name, names)
+	}
+	return encodingHasher{h}, nil
+}
+
+// encodingHasher suffixes the key of objects stored with a Content-Encoding,
+// e.g. "1234+gzip". Keys are derived from the stored bytes, so a gzipped
+// object and a plain object only match when their stored bytes match, and the
+// suffix keeps a plain object from matching an encoded one whose stored bytes
+// happen to be identical. A gzipped object and its plain twin are therefore
+// never deduped against each other.
+type encodingHasher struct {
+	Hasher
+}
+
+func (h encodingHasher) Key(ctx context.Context, attrs *storage.ObjectAttrs, obj *storage.ObjectHandle) (string, error) {
+	key, err := h.Hasher.Key(ctx, attrs, obj)
+	if err != nil || attrs.ContentEncoding == "" {
+		return key, err
+	}
+	return key + "+" + strings.ToLower(attrs.ContentEncoding), nil
+}
+
+// crc32Hasher keys objects on the crc32c reported by GCS.
+type crc32Hasher struct{}
+
+func (crc32Hasher) Key(_ context.Context, attrs *storage.ObjectAttrs, _ *storage.ObjectHandle) (string, error) {
+	return strconv.FormatUint(uint64(attrs.CRC32C), 10), nil
+}
+
+// crc32SizeHasher keys objects on the crc32c and size reported by GCS, which
+// collides far less than the crc32c alone when deduping large sets of
+// unrelated buckets.
+type crc32SizeHasher struct{}
+
+func (crc32SizeHasher) Key(_ context.Context, attrs *storage.ObjectAttrs, _ *storage.ObjectHandle) (string, error) {
+	return strconv.FormatUint(uint64(attrs.CRC32C), 10) + ":" + strconv.FormatInt(attrs.Size, 10), nil
+}
+
+// md5Hasher keys objects on the md5 reported by GCS. Composite objects have
+// no md5 and cannot be keyed.
+type md5Hasher struct{}
+
+func (md5Hasher) Key(_ context.Context, attrs *storage.ObjectAttrs, _ *storage.ObjectHandle) (string, error) {
+	if len(attrs.MD5) == 0 {
+		return "", errors.New("object has no md5")
+	}
+	return hex.EncodeToString(attrs.MD5), nil
+}
+
+// sha256Hasher keys objects on the sha256 of their content, which requires
+// downloading every object. Encoded objects are read as stored, without
+// decompressive transcoding, to match the crc32c and md5 GCS reports.
+type sha256Hasher struct{}
+
+func (sha256Hasher) Key(ctx context.Context, _ *storage.ObjectAttrs, obj *storage.ObjectHandle) (string, error) {
+	r, err := obj.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
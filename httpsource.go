@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// srcURLPlaceholder is replaced by the escaped object name in -src-url.
+const srcURLPlaceholder = "{name}"
+
+// srcURL renders the signed URL template for an object name.
+func (svc *ImgDeduper) srcURL(name string) string {
+	return strings.ReplaceAll(svc.SrcURL, srcURLPlaceholder, (&url.URL{Path: name}).EscapedPath())
+}
+
+// validateSrcURL checks the -src-url options. Objects can't be listed over
+// HTTP, their names come from -names-file, and only the hash strategies
+// served in the response headers are available.
+func (svc *ImgDeduper) validateSrcURL() error {
+	if svc.SrcURL == "" {
+		return nil
+	}
+	if !strings.Contains(svc.SrcURL, srcURLPlaceholder) {
+		return fmt.Errorf("src url %q has no %s placeholder", svc.SrcURL, srcURLPlaceholder)
+	}
+	if svc.NamesFile == "" {
+		return errors.New("src url requires -names-file, objects can't be listed over http")
+	}
+	if svc.Transform {
+		return errors.New("src url can't be combined with -transform")
+	}
+	if svc.HashStrategy != "crc32" && svc.HashStrategy != "md5" {
+		return fmt.Errorf("src url supports the crc32 and md5 hash strategies, not %q", svc.HashStrategy)
+	}
+	return nil
+}
+
+// httpSourceAttrs builds the attrs of an object from a HEAD of its signed URL.
+func httpSourceAttrs(ctx context.Context, rawURL, name string) (*storage.ObjectAttrs, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, storage.ErrObjectNotExist
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("head %s: %s", name, resp.Status)
+	}
+
+	return httpSourceHeaders(resp, name), nil
+}
+
+// httpSourceHeaders reads object attrs from response headers. The crc32c and
+// md5 come from the x-goog-hash header GCS serves, the updated time from
+// Last-Modified.
+func httpSourceHeaders(resp *http.Response, name string) *storage.ObjectAttrs {
+	attrs := &storage.ObjectAttrs{
+		Name:            name,
+		Size:            resp.ContentLength,
+		ContentType:     resp.Header.Get("Content-Type"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+	}
+	for _, h := range resp.Header.Values("X-Goog-Hash") {
+		for _, kv := range strings.Split(h, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			b, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				continue
+			}
+			switch {
+			case k == "crc32c" && len(b) == 4:
+				attrs.CRC32C = binary.BigEndian.Uint32(b)
+			case k == "md5":
+				attrs.MD5 = b
+			}
+		}
+	}
+	// GCS serves the object's updated time
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		attrs.Updated = t
+	}
+	return attrs
+}
+
+// httpSourceCopy downloads the object at url and uploads it to dst. Any
+// preconditions set on dst apply to the upload. When the response carries a
+// crc32c GCS validates the upload against it.
+func httpSourceCopy(ctx context.Context, url string, dst *storage.ObjectHandle) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	// keep encoded objects as stored
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get: %s", resp.Status)
+	}
+
+	attrs := httpSourceHeaders(resp, "")
+	w := dst.NewWriter(ctx)
+	w.ContentType = attrs.ContentType
+	w.ContentEncoding = attrs.ContentEncoding
+	if attrs.CRC32C != 0 {
+		w.CRC32C = attrs.CRC32C
+		w.SendCRC32C = true
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
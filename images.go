@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func insertImage(ctx context.Context, roach *pgxpool.Pool, i *storage.ObjectAttrs, s, strategy, key, runID string) error {
+	ctx, span := tracer.Start(ctx, "db.insert")
+	defer span.End()
+
+	err := retryConn(ctx, "insert", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			inner := func() error {
+				_, err := tx.Exec(ctx,
+					"INSERT INTO images (name, section, prefix, size, crc32, hash_strategy, hash, content_encoding, run_id, bucket, copied_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULL) ON CONFLICT (name) DO NOTHING", i.Name, s, filepath.Dir(i.Name), i.Size, i.CRC32C, strategy, key, i.ContentEncoding, runID, i.Bucket)
+				if err != nil {
+					return err
+				}
+				return nil
+			}
+
+			return inner()
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// deleteImage function removes an image row. It uses crdbpgx for transaction handling (retries).
+func deleteImage(ctx context.Context, roach *pgxpool.Pool, name string) error {
+	return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "DELETE FROM images WHERE name = $1", name)
+		return err
+	})
+}
+
+// markCopied records that the dst copy of the image name is stored, staged
+// when it awaits a promote. Only copied rows count as originals, so a row
+// whose copy failed doesn't stop a later run from copying the image. A row
+// stamped with the epoch is stamped again, see -reconcile-legacy.
+func markCopied(ctx context.Context, roach *pgxpool.Pool, name string, staged bool) error {
+	ctx, span := tracer.Start(ctx, "db.copied")
+	defer span.End()
+
+	return retryConn(ctx, "copied", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "UPDATE images SET copied_at = now(), staged_at = CASE WHEN $2 THEN now() END WHERE name = $1 AND (copied_at IS NULL OR copied_at = '1970-01-01 00:00:00+00')", name, staged)
+			return err
+		})
+	})
+}
+
+// getImageCount function performs a cockroachdb sql query using pgx. It uses crdbpgx for transaction handling (retries).
+// The inner function allows to return the count value from the query.
+func getImageCount(ctx context.Context, roach *pgxpool.Pool, strategy, key string) (int, error) {
+	ctx, span := tracer.Start(ctx, "db.count")
+	defer span.End()
+
+	// init count
+	count := 0
+
+	// check if image exists in database
+	err := retryConn(ctx, "count", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			inner := func() error {
+				// inner function
+				rows, err := tx.Query(ctx, "SELECT COUNT(*) FROM images WHERE hash_strategy = $1 AND hash = $2", strategy, key)
+				if err != nil {
+					return err
+				}
+
+				for rows.Next() {
+					if err := rows.Scan(&count); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			}
+
+			return inner()
+		})
+	})
+	if err != nil {
+		return count, err
+	}
+
+	return count, nil
+}
+
+// getDuplicate returns the name of an image stored with the same dedup key.
+// Other images are preferred over name itself, which is only returned when it
+// is the sole match, e.g. an object already stored by a previous run.
+func getDuplicate(ctx context.Context, roach *pgxpool.Pool, m dedupMatch, name string) (string, bool, error) {
+	ctx, span := tracer.Start(ctx, "db.duplicate")
+	defer span.End()
+
+	query := "SELECT name FROM images WHERE " + m.where + " AND copied_at IS NOT NULL ORDER BY name = " + m.param(1) + ", name LIMIT 1"
+	args := append(append([]any{}, m.args...), name)
+	original := ""
+	err := retryConn(ctx, "duplicate", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			err := tx.QueryRow(ctx, query, args...).Scan(&original)
+			if errors.Is(err, pgx.ErrNoRows) {
+				original = ""
+				return nil
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return original, original != "", nil
+}
+
+// getOriginal returns the name and src bucket of an image stored with the
+// same dedup key, regardless of its name, prefix or section. Images stored
+// from excludeBucket are ignored unless it is empty.
+func getOriginal(ctx context.Context, roach *pgxpool.Pool, m dedupMatch, excludeBucket string) (string, string, bool, error) {
+	ctx, span := tracer.Start(ctx, "db.original")
+	defer span.End()
+
+	exclude := m.param(1)
+	query := "SELECT name, bucket FROM images WHERE " + m.where + " AND copied_at IS NOT NULL AND (" + exclude + " = '' OR bucket IS DISTINCT FROM " + exclude + ") ORDER BY name LIMIT 1"
+	args := append(append([]any{}, m.args...), excludeBucket)
+	var name, bucket string
+	found := false
+	err := retryConn(ctx, "original", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			var b *string
+			err := tx.QueryRow(ctx, query, args...).Scan(&name, &b)
+			if errors.Is(err, pgx.ErrNoRows) {
+				found = false
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			found = true
+			// rows stored before the bucket column existed have none
+			if b != nil {
+				bucket = *b
+			}
+			return nil
+		})
+	})
+	return name, bucket, found, err
+}
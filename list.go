@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/go-kit/log/level"
+	"google.golang.org/api/iterator"
+)
+
+// list prints the name of every listed object to stdout, with its size and
+// crc32 when -list-details is set, to check a prefix or glob before a run.
+// Objects are printed in listing order and nothing else is read or written.
+func (svc *ImgDeduper) list(b objectSource) error {
+	l := loggerFromContext(svc.Context)
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	b = svc.shardObjects(b)
+	count := 0
+	for svc.Ready.Load() {
+		if svc.Limit != 0 && count >= svc.Limit {
+			level.Info(l).Log("msg", "limit reached", "limit", svc.Limit)
+			break
+		}
+		attrs, err := b.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrListing, err)
+		}
+
+		count++
+		svc.stats.setCursor(attrs.Name)
+		if svc.ListDetails {
+			_, err = fmt.Fprintf(w, "%s\t%d\t%d\n", attrs.Name, attrs.Size, attrs.CRC32C)
+		} else {
+			_, err = fmt.Fprintln(w, attrs.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	level.Info(l).Log("msg", "list summary", "objects", count)
+	return nil
+}
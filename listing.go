@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	listPageSize   = 1000
+	listMaxRetries = 5
+	listRetryDelay = time.Second
+)
+
+// wholeBucketPrefix is the -prefix default, listing every image of the bucket.
+const wholeBucketPrefix = "**"
+
+// listingQuery builds the src listing query. An explicit glob is used
+// verbatim. An empty or ** prefix lists the images of the whole bucket at any
+// depth, top-level objects included, which the prefix/*.jpg template can't
+// express. Any other prefix lists the images directly under it, a trailing /
+// is ignored.
+func listingQuery(prefix, glob string) (*storage.Query, error) {
+	if glob != "" {
+		if strings.TrimSpace(glob) == "" {
+			return nil, errors.New("glob must not be blank")
+		}
+		return &storage.Query{MatchGlob: glob}, nil
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" || prefix == wholeBucketPrefix {
+		return &storage.Query{MatchGlob: "**.jpg"}, nil
+	}
+	return &storage.Query{MatchGlob: prefix + "/*.jpg"}, nil
+}
+
+// listAttrs returns the object attrs the enabled features read, the listing
+// fetches only those to save metadata bandwidth on large buckets. An attr
+// left out here reads as its zero value, so every feature reading listed
+// attrs must add its fields.
+func (svc *ImgDeduper) listAttrs() []string {
+	// dedup key, encodingHasher and the images row
+	attrs := []string{"Name", "Bucket", "Size", "CRC32C", "ContentEncoding"}
+	if svc.HashStrategy == "md5" {
+		attrs = append(attrs, "MD5")
+	}
+	if svc.OverwriteNew || svc.predicate.needsUpdated() || (svc.DatePrefix && svc.DateField == dateUpdated) {
+		attrs = append(attrs, "Updated")
+	}
+	// the time dating dst names, see datedPrefix
+	if svc.DatePrefix && svc.DateField != dateUpdated {
+		attrs = append(attrs, dateFields[svc.DateField])
+	}
+	if svc.TagDupes {
+		attrs = append(attrs, "Metadata", "Metageneration")
+	}
+	// copyAttrs carries the content headers and metadata over, routes match
+	// on the content type
+	if svc.StorageClass != "" || !svc.KeepMetadata || len(svc.Metadata) > 0 || svc.Provenance {
+		attrs = append(attrs, "ContentType", "ContentLanguage", "ContentDisposition", "CacheControl")
+		if svc.KeepMetadata && !svc.TagDupes {
+			attrs = append(attrs, "Metadata")
+		}
+	} else if len(svc.ContentRoutes) > 0 {
+		attrs = append(attrs, "ContentType")
+	}
+	return attrs
+}
+
+// pagedIterator lists a bucket a page at a time. A page that fails to load is
+// fetched again from the same page token, so a transient error neither ends
+// the run nor skips objects, and objects are yielded exactly once in order.
+type pagedIterator struct {
+	ctx   context.Context
+	src   *storage.BucketHandle
+	query *storage.Query
+	pager *iterator.Pager
+	token string
+	page  []*storage.ObjectAttrs
+	done  bool
+}
+
+func newPagedIterator(ctx context.Context, src *storage.BucketHandle, q *storage.Query) *pagedIterator {
+	it := &pagedIterator{ctx: ctx, src: src, query: q}
+	it.reset()
+	return it
+}
+
+// reset starts a new pager from the last successfully fetched page token, a
+// pager's error is sticky so it can't be reused after a failure.
+func (it *pagedIterator) reset() {
+	it.pager = iterator.NewPager(it.src.Objects(it.ctx, it.query), listPageSize, it.token)
+}
+
+// Next returns the next object, iterator.Done once the listing is exhausted.
+func (it *pagedIterator) Next() (*storage.ObjectAttrs, error) {
+	for len(it.page) == 0 {
+		if it.done {
+			return nil, iterator.Done
+		}
+		if err := it.fetch(); err != nil {
+			return nil, err
+		}
+	}
+
+	attrs := it.page[0]
+	it.page = it.page[1:]
+	return attrs, nil
+}
+
+// fetch loads the next page, retrying failures with a linear backoff.
+func (it *pagedIterator) fetch() error {
+	l := loggerFromContext(it.ctx)
+
+	for attempt := 1; ; attempt++ {
+		var page []*storage.ObjectAttrs
+		token, err := it.pager.NextPage(&page)
+		if err == nil {
+			it.page = page
+			it.token = token
+			it.done = token == ""
+			return nil
+		}
+		if attempt > listMaxRetries || it.ctx.Err() != nil {
+			return err
+		}
+
+		metricsFromContext(it.ctx).listPageRetries.Inc()
+		level.Warn(l).Log("msg", "failed to list bucket page, retrying", "attempt", attempt, "error", err)
+		select {
+		case <-it.ctx.Done():
+			return it.ctx.Err()
+		case <-time.After(time.Duration(attempt) * listRetryDelay):
+		}
+		it.reset()
+	}
+}
+
+// sleepJitter waits a random duration up to -start-jitter before the listing
+// begins, returning the context error when the service is cancelled first.
+func (svc *ImgDeduper) sleepJitter() error {
+	if svc.StartJitter <= 0 {
+		return nil
+	}
+	d := time.Duration(rand.Int63n(int64(svc.StartJitter)))
+	level.Info(loggerFromContext(svc.Context)).Log("msg", "delaying start", "delay", d, "max", svc.StartJitter)
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-svc.Context.Done():
+		return svc.Context.Err()
+	case <-t.C:
+		return nil
+	}
+}
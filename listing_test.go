@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestListingQuery(t *testing.T) {
+	tests := []struct {
+		prefix string
+		glob   string
+		want   string
+	}{
+		{"", "", "**.jpg"},
+		{"**", "", "**.jpg"},
+		{"**/", "", "**.jpg"},
+		{"/", "", "**.jpg"},
+		{"photos", "", "photos/*.jpg"},
+		{"photos/", "", "photos/*.jpg"},
+		{"photos/2024", "", "photos/2024/*.jpg"},
+		{"photos", "**.png", "**.png"},
+	}
+	for _, tt := range tests {
+		q, err := listingQuery(tt.prefix, tt.glob)
+		if err != nil {
+			t.Errorf("listingQuery(%q, %q): %v", tt.prefix, tt.glob, err)
+			continue
+		}
+		if q.MatchGlob != tt.want {
+			t.Errorf("listingQuery(%q, %q) MatchGlob = %q, want %q", tt.prefix, tt.glob, q.MatchGlob, tt.want)
+		}
+	}
+}
+
+func TestListingQueryBlankGlob(t *testing.T) {
+	if _, err := listingQuery("photos", "  "); err == nil {
+		t.Error("listingQuery with a blank glob: want an error")
+	}
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -10,15 +15,51 @@ import (
 
 type ctxLogger struct{}
 
-func newLogger(debug bool) *log.Logger {
+type ctxRequestID struct{}
+
+// log levels of -log-level
+const (
+	logDebug = "debug"
+	logInfo  = "info"
+	logWarn  = "warn"
+	logError = "error"
+)
+
+// logLevel resolves -log-level and its shorthands, -debug for debug and
+// -quiet for warn.
+func logLevel(name string, debug, quiet bool) (string, error) {
+	switch {
+	case debug && quiet:
+		return "", errors.New("-debug and -quiet are mutually exclusive")
+	case debug:
+		return logDebug, nil
+	case quiet:
+		return logWarn, nil
+	}
+	switch name {
+	case logDebug, logInfo, logWarn, logError:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown log level %q, expected %s, %s, %s or %s", name, logDebug, logInfo, logWarn, logError)
+}
+
+// newLogger returns a logfmt logger dropping the lines below lvl, one of
+// the levels resolved by logLevel.
+func newLogger(lvl string) *log.Logger {
 	var logger log.Logger
 	{
 		logger = log.NewLogfmtLogger(os.Stdout)
-		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
-		logger = log.With(logger, "caller", log.DefaultCaller)
-		if !debug {
+		// filter below the context so caller reports the logging line
+		switch lvl {
+		case logInfo:
 			logger = level.NewFilter(logger, level.AllowInfo())
+		case logWarn:
+			logger = level.NewFilter(logger, level.AllowWarn())
+		case logError:
+			logger = level.NewFilter(logger, level.AllowError())
 		}
+		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
 	return &logger
 }
@@ -37,3 +78,106 @@ func loggerFromContext(ctx context.Context) log.Logger {
 	logger := log.NewLogfmtLogger(w)
 	return logger
 }
+
+// newRequestID returns a short random ID tagging the log lines of an object.
+func newRequestID() string {
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
+
+// contextWithRequestID tags the context logger with id, every line logged
+// through loggerFromContext(ctx) carries it as req_id.
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	l := log.With(loggerFromContext(ctx), "req_id", id)
+	ctx = context.WithValue(ctx, ctxRequestID{}, id)
+	return contextWithLogger(ctx, &l)
+}
+
+// requestIDFromContext returns the request ID of ctx, empty without one.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxRequestID{}).(string)
+	return id
+}
+
+// errLogger returns the sampled error logger, tagged with the request ID of
+// ctx if it has one.
+func (svc *ImgDeduper) errLogger(ctx context.Context) log.Logger {
+	if id := requestIDFromContext(ctx); id != "" {
+		return log.With(svc.errLog, "req_id", id)
+	}
+	return svc.errLog
+}
+
+// samplingLogger collapses repeated log lines. The first line of a given msg
+// and error is logged, identical lines within window are counted and the
+// count is attached to the next line logged once the window has passed.
+type samplingLogger struct {
+	next   log.Logger
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]*sample
+}
+
+type sample struct {
+	start      time.Time
+	suppressed int
+}
+
+// newSamplingLogger wraps next with sampling. A zero window disables it.
+func newSamplingLogger(next log.Logger, window time.Duration) log.Logger {
+	if window <= 0 {
+		return next
+	}
+	return &samplingLogger{
+		next:   next,
+		window: window,
+		seen:   make(map[string]*sample),
+	}
+}
+
+func (sl *samplingLogger) Log(keyvals ...interface{}) error {
+	var msg, errv interface{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		switch keyvals[i] {
+		case "msg":
+			msg = keyvals[i+1]
+		case "error":
+			errv = keyvals[i+1]
+		}
+	}
+	key := fmt.Sprintf("%v|%v", msg, errv)
+	now := time.Now()
+
+	sl.mu.Lock()
+	s, ok := sl.seen[key]
+	if ok && now.Sub(s.start) < sl.window {
+		s.suppressed++
+		sl.mu.Unlock()
+		return nil
+	}
+	suppressed := 0
+	if ok {
+		suppressed = s.suppressed
+	}
+	sl.seen[key] = &sample{start: now}
+	sl.prune(now)
+	sl.mu.Unlock()
+
+	if suppressed > 0 {
+		keyvals = append(keyvals, "suppressed", fmt.Sprintf("%d similar errors suppressed", suppressed))
+	}
+	return sl.next.Log(keyvals...)
+}
+
+// prune drops expired samples so distinct messages don't accumulate. Counts
+// of expired samples are lost, which only affects messages that stopped
+// recurring.
+func (sl *samplingLogger) prune(now time.Time) {
+	if len(sl.seen) < 1024 {
+		return
+	}
+	for k, s := range sl.seen {
+		if now.Sub(s.start) >= sl.window {
+			delete(sl.seen, k)
+		}
+	}
+}
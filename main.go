@@ -4,13 +4,18 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"image/jpeg"
+	"io"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
-	"cloud.google.com/go/storage"
+	"github.com/cockroachdb/cockroach-go/v2/crdb"
 	"github.com/go-kit/log/level"
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const (
@@ -23,50 +28,346 @@ type DBOptions struct {
 	DBUsername         string
 	DBPassword         string
 	DBConnectionString string
+	StatementTimeout   time.Duration
+	MaxRetries         int
+	ConnRetries        int
+	SSLMode            string
+	SSLRootCert        string
+	SSLCert            string
+	SSLKey             string
 }
 
-// SvcOptions are service specific process inputs such as arguments
-func parseCLIArgs() (bool, string, SvcOptions, DBOptions) {
-	// toggle debug logging
-	debug := flag.Bool("debug", false, "Debug logging level")
-	limit := flag.Int("limit", 0, "Number of files to process before terminating")
-	port := flag.String("port", "8080", "Port to listen on")
+// commands are the subcommands, the first argument selects one. Without a
+// subcommand the flags are parsed as scan flags.
+var commands = []struct {
+	name  string
+	usage string
+	flags []func(*flag.FlagSet, *cliArgs)
+}{
+	{modeScan, "dedup src objects into dst and record them in the database (default)",
+		[]func(*flag.FlagSet, *cliArgs){commonFlags, dbFlags, listingFlags, dstFlags, hashFlags, schemaFlags, scanFlags, routeFlags, stagingFlags, createDstFlags, breakerFlags, checkpointFlags}},
+	{modeVerify, "check every src object exists in dst with a matching crc32",
+		[]func(*flag.FlagSet, *cliArgs){commonFlags, dbFlags, listingFlags, dstFlags, routeFlags, breakerFlags}},
+	{modeReport, "report which src objects are already stored, read-only",
+		[]func(*flag.FlagSet, *cliArgs){commonFlags, dbFlags, listingFlags, hashFlags, reportFlags, breakerFlags}},
+	{modeMigrate, "apply the database schema migrations and exit",
+		[]func(*flag.FlagSet, *cliArgs){commonFlags, dbFlags, schemaFlags}},
+	{modeReconcile, "copy images stored in the database but missing from dst, safe to repeat",
+		[]func(*flag.FlagSet, *cliArgs){commonFlags, dbFlags, listingFlags, dstFlags, schemaFlags, scanFlags, routeFlags, stagingFlags, reconcileFlags, breakerFlags}},
+	{modeGC, "delete database rows whose object no longer exists in src or dst",
+		[]func(*flag.FlagSet, *cliArgs){commonFlags, dbFlags, listingFlags, dstFlags, routeFlags, gcFlags, breakerFlags}},
+	{modePromote, "move staged copies to their final dst names once verified, safe to repeat",
+		[]func(*flag.FlagSet, *cliArgs){commonFlags, dbFlags, listingFlags, dstFlags, routeFlags, stagingFlags, promoteFlags, breakerFlags}},
+	{modeList, "print the names of the src objects the listing matches, without a database",
+		[]func(*flag.FlagSet, *cliArgs){commonFlags, listingFlags, listOutputFlags}},
+	{modeNotify, "create a Pub/Sub topic and register an OBJECT_FINALIZE notification of src on it, safe to repeat",
+		[]func(*flag.FlagSet, *cliArgs){commonFlags, notificationFlags}},
+	{modeSelfcheck, "validate the scan configuration, buckets, database and schema, then exit",
+		[]func(*flag.FlagSet, *cliArgs){commonFlags, dbFlags, listingFlags, dstFlags, hashFlags, schemaFlags, scanFlags, routeFlags, stagingFlags, createDstFlags, breakerFlags}},
+	{modeTestConn, "ping the database and read the src and dst bucket attrs, exit 0 when all are reachable",
+		[]func(*flag.FlagSet, *cliArgs){commonFlags, dbFlags, dstFlags, testConnFlags}},
+}
+
+// cliArgs collects the flag values of a subcommand.
+type cliArgs struct {
+	debug       bool
+	quiet       bool
+	logLevel    string
+	port        string
+	listen      string
+	enablePprof bool
+	printConfig bool
+	svc         SvcOptions
+	db          DBOptions
+	storage     StorageOptions
+	tracing     TracingOptions
+}
 
-	srcBucketName := flag.String("src", "src_bucket_name", "Source GCP S3 bucket name")
-	dstBucketName := flag.String("dst", "dst_bucket_name", "Destination GCP S3 bucket name")
-	prefix := flag.String("prefix", "**", "S3 bucket prefix on which to operate")
+// commonFlags are shared by every subcommand: logging, web server, tracing
+// and the src bucket.
+func commonFlags(fs *flag.FlagSet, a *cliArgs) {
+	// log verbosity, -debug and -quiet are shorthands of -log-level
+	fs.StringVar(&a.logLevel, "log-level", logInfo, "Lowest level logged: debug, info, warn or error")
+	fs.BoolVar(&a.debug, "debug", false, "Debug logging level, same as -log-level debug")
+	fs.BoolVar(&a.quiet, "quiet", false, "Only log warnings and errors, same as -log-level warn")
+	fs.DurationVar(&a.svc.LogSampling, "log-sample-window", time.Minute, "Collapse identical per-object errors within this window (0 disables)")
+	fs.StringVar(&a.listen, "listen", "", "host:port the metrics, health and stats server listens on, e.g. 127.0.0.1:8080 (default :8080)")
+	fs.StringVar(&a.port, "port", "8080", "Port to listen on on all interfaces (deprecated, use -listen)")
+	fs.StringVar(&a.svc.MetricsNS, "metrics-namespace", defaultMetricsNamespace, "Namespace prefixing every metric name")
+	fs.StringVar(&a.svc.MetricsSub, "metrics-subsystem", "", "Optional subsystem added to every metric name after the namespace")
+	fs.StringVar(&a.svc.Pushgateway, "pushgateway", "", "Prometheus Pushgateway URL the final metrics are pushed to on shutdown")
+	fs.StringVar(&a.svc.PushJob, "pushgateway-job", defaultPushJob, "Job label of metrics pushed to the Pushgateway")
+	fs.StringVar(&a.svc.WebhookURL, "webhook-url", "", "URL POSTed a JSON summary (Slack compatible) when the run completes, is stopped or fails")
+	fs.BoolVar(&a.enablePprof, "pprof", false, "Serve pprof handlers on the metrics port (expose internally only)")
+	fs.BoolVar(&a.printConfig, "print-config", false, "Print the resolved configuration as JSON, secrets redacted, and exit")
+	fs.StringVar(&a.tracing.Endpoint, "otel-endpoint", "", "OTLP/HTTP trace collector host:port (tracing disabled when empty)")
+	fs.BoolVar(&a.tracing.Insecure, "otel-insecure", false, "Export traces over plain HTTP")
 
-	dbUsername := flag.String("u", "database_username", "Database Username")
-	dbPassword := flag.String("p", "database_password", "Database Password")
-	dbConnectionString := flag.String("c", "database_connection_string", "Database Connection String")
+	fs.StringVar(&a.svc.SrcBucketName, "src", "src_bucket_name", "Source GCP S3 bucket name")
+	fs.StringVar(&a.svc.SrcURL, "src-url", "", "Signed URL template src objects are read from over HTTP(S) instead of the GCS client, {name} is replaced by the object name (requires -names-file)")
+	fs.StringVar(&a.storage.Src.CredentialsFile, "credentials-file", "", "Service account credentials file (defaults to ADC)")
+	fs.StringVar(&a.storage.Src.WIFConfig, "wif-config", "", "Workload Identity Federation external account config, instead of a credentials file")
+	fs.StringVar(&a.storage.Src.ImpersonateSA, "impersonate-sa", "", "Service account to impersonate")
+}
 
-	flag.Parse()
+// dbFlags connect to the database, every subcommand but list and
+// setup-notifications uses it.
+func dbFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.StringVar(&a.db.DBUsername, "u", "database_username", "Database Username")
+	fs.StringVar(&a.db.DBPassword, "p", "database_password", "Database Password")
+	fs.StringVar(&a.db.DBConnectionString, "c", "database_connection_string", "Database Connection String")
+	fs.DurationVar(&a.db.StatementTimeout, "db-statement-timeout", 30*time.Second, "Database statement timeout (0 disables)")
+	fs.IntVar(&a.db.ConnRetries, "db-conn-retries", 3, "Max retries of a database operation on connection failures (0 disables)")
+	fs.IntVar(&a.db.MaxRetries, "db-max-retries", 10, "Max retries of a database transaction on retryable errors")
+	fs.BoolVar(&a.svc.PinConns, "db-pin-conns", false, "Pin a database connection to each worker for the run instead of acquiring one per transaction")
+	fs.StringVar(&a.db.SSLMode, "db-ssl-mode", "", "Database TLS mode: disable, require, verify-ca or verify-full, overriding the connection string sslmode")
+	fs.StringVar(&a.db.SSLRootCert, "db-ssl-root-cert", "", "CA certificate file verifying the database server")
+	fs.StringVar(&a.db.SSLCert, "db-ssl-cert", "", "Client certificate file authenticating to the database")
+	fs.StringVar(&a.db.SSLKey, "db-ssl-key", "", "Client certificate key file")
+}
+
+// listingFlags select and pace the src objects processed.
+func listingFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.IntVar(&a.svc.Workers, "workers", 1, "Number of concurrent workers")
+	fs.IntVar(&a.svc.QueueSize, "queue-size", 0, "Number of listed objects buffered for workers, listing blocks when full (default 2x workers)")
+	fs.Int64Var(&a.svc.MaxMemory, "max-memory", 0, "Heap size in bytes above which fewer workers take objects until it drops, also the Go soft memory limit (0 disables)")
+	fs.IntVar(&a.svc.Limit, "limit", 0, "Number of files to process before terminating")
+	fs.DurationVar(&a.svc.DrainTimeout, "drain-timeout", 30*time.Second, "Time to wait for in-flight objects on shutdown before cancelling them")
+	fs.DurationVar(&a.svc.MaxRuntime, "max-runtime", 0, "Stop gracefully, as on SIGTERM, after running this long (0 disables)")
+	fs.DurationVar(&a.svc.StartJitter, "start-jitter", 0, "Wait a random duration up to this long before listing, spreading replicas started together (0 disables)")
+	fs.StringVar(&a.svc.Prefix, "prefix", wholeBucketPrefix, "Src prefix whose images are listed, ** or empty for the whole bucket")
+	fs.StringVar(&a.svc.Glob, "glob", "", "MatchGlob expression used verbatim instead of the prefix/*.jpg template")
+	fs.StringVar(&a.svc.NamesFile, "names-file", "", "Local path or gs:// URI of newline-delimited object names to process instead of listing")
+	fs.StringVar(&a.svc.StartAfter, "start-after", "", "Only list objects whose name sorts after this one")
+	fs.IntVar(&a.svc.ShardIndex, "shard-index", 0, "Shard of the objects this replica handles, from 0 to -shard-count - 1")
+	fs.IntVar(&a.svc.ShardCount, "shard-count", 1, "Number of replicas dividing the objects by a hash of their name")
+}
+
+// dstFlags locate the dst bucket and the names of copied objects.
+func dstFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.StringVar(&a.svc.DstBucketName, "dst", "dst_bucket_name", "Destination GCP S3 bucket name")
+	fs.StringVar(&a.svc.DstProject, "dst-project", "", "Project billed for dst bucket requests when it lives in another project")
+	fs.StringVar(&a.svc.DstPrefix, "dst-prefix", "", "Prefix prepended to destination object names")
+	fs.BoolVar(&a.svc.DatePrefix, "dst-prefix-by-date", false, "Copy objects under a YYYY/MM/DD/ of their -dst-date-field time in UTC, after -dst-prefix")
+	fs.StringVar(&a.svc.DateField, "dst-date-field", dateUpdated, "Object time partitioning -dst-prefix-by-date names: updated, created or custom-time")
+	fs.IntVar(&a.svc.DstStrip, "dst-strip", 0, "Number of leading path segments stripped from destination object names")
+	fs.StringVar(&a.storage.Dst.CredentialsFile, "dst-credentials-file", "", "Credentials file for the dst bucket if it needs a different identity")
+	fs.StringVar(&a.storage.Dst.WIFConfig, "dst-wif-config", "", "Workload Identity Federation config for the dst bucket if it needs a different identity")
+	fs.StringVar(&a.storage.Dst.ImpersonateSA, "dst-impersonate-sa", "", "Service account to impersonate for the dst bucket")
+}
+
+func hashFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.StringVar(&a.svc.HashStrategy, "hash-strategy", "crc32", "Dedup key strategy: crc32, crc32size, md5 or sha256")
+	fs.StringVar(&a.svc.MissingCRC, "missing-crc32c", missingCRCStream, "Objects listed with a crc32c of 0: stream computes it by downloading them, skip leaves them alone, ignore dedups them on 0")
+	fs.Var((*listFlag)(&a.svc.DedupKeys), "dedup-keys", "Comma separated images columns an object must match to be a duplicate: hash, crc32, size, content_encoding, section, prefix, bucket (default hash)")
+}
+
+func schemaFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.BoolVar(&a.svc.CRCIndex, "crc32-index", true, "Create secondary indexes on the dedup columns")
+	fs.BoolVar(&a.svc.MigrateTypes, "migrate-column-types", false, "Convert the legacy FLOAT size and OID crc32 columns to INT8")
+}
+
+func scanFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.IntVar(&a.svc.SeenLimit, "dedup-cache-size", 1000000, "Max dedup keys remembered in memory to dedup objects within a run")
+	fs.IntVar(&a.svc.BatchCheck, "db-batch-check", 0, "Look the crc32 of this many listed objects up with one query, skipping the dedup lookup of those not stored (0 looks every object up)")
+	fs.BoolVar(&a.svc.DrainOnDBErr, "drain-on-db-error", false, "Pause the scan while the database is unreachable and retry the objects it failed once it answers, instead of failing them")
+	fs.BoolVar(&a.svc.SectionLabels, "section-metrics", false, "Label object metrics with the object's section (unbounded cardinality)")
+	fs.Var((*listFlag)(&a.svc.SectionAllow), "section-allowlist", "Comma separated sections labelled in object metrics, others are labelled 'other'")
+	fs.IntVar(&a.svc.SectionLimit, "section-concurrency", 0, "Max objects of a single section processed concurrently (0 disables)")
+	fs.IntVar(&a.svc.SectionStats, "section-stats", defaultSectionStats, "Max sections whose outcomes and duplicate ratio /stats reports apart, the others are reported as '"+otherSection+"' (0 disables)")
+	fs.BoolVar(&a.svc.SectionRatios, "section-ratio-metrics", false, "Export the duplicate ratio of the -section-stats sections as the section_duplicate_ratio gauge")
+	fs.Var((*listFlag)(&a.svc.Exclude), "exclude", "Skip object names matching this path.Match pattern, where * does not match /, before any db or storage work (repeatable)")
+	fs.IntVar(&a.svc.CopyLimit, "copy-limit", 0, "Number of files to copy before terminating, independent of -limit")
+	fs.DurationVar(&a.svc.ObjectTimeout, "object-timeout", 0, "Abandon an object still processing after this long, counted as a timeout (0 disables)")
+	fs.Int64Var(&a.svc.MaxSize, "max-size", 0, "Skip objects larger than this size in bytes (0 disables)")
+	fs.Int64Var(&a.svc.MinSize, "min-size", 0, "Skip objects smaller than this size in bytes (0 disables)")
+	fs.Var(timeFlag{&a.svc.UpdatedSince}, "updated-since", "Skip objects last updated before this RFC 3339 time")
+	fs.Var(timeFlag{&a.svc.UpdatedUntil}, "updated-until", "Skip objects last updated at or after this RFC 3339 time")
+	fs.Var((*listFlag)(&a.svc.Sections), "sections", "Comma separated sections to store and copy, skipping the others ("+rootSection+" for objects at the bucket root)")
+	fs.BoolVar(&a.svc.Preflight, "preflight", true, "Verify src read and dst write permissions before processing")
+	fs.BoolVar(&a.svc.SkipExisting, "skip-existing", false, "Skip copying objects already present in the dst bucket, only inserting their row when it is missing")
+	fs.BoolVar(&a.svc.ValidateImgs, "validate-images", false, "Download and fully decode every image, skipping corrupt ones (expensive)")
+	fs.BoolVar(&a.svc.RecordCorrupt, "record-corrupt", false, "Record images rejected by -validate-images in the failed_images table")
+	fs.BoolVar(&a.svc.ExtractExif, "extract-exif", false, "Read the first 128KiB of every image and store its EXIF capture time, camera model and GPS coordinates")
+	fs.BoolVar(&a.svc.Overwrite, "overwrite", false, "Replace existing dst objects instead of leaving them untouched")
+	fs.BoolVar(&a.svc.OverwriteNew, "overwrite-if-newer", false, "Replace existing dst objects only when the src object was updated after them")
+	fs.BoolVar(&a.svc.TagDupes, "tag-duplicates", false, "Tag duplicate source objects with a '"+duplicateOfKey+"' metadata key naming the stored original")
+	fs.IntVar(&a.svc.CopyWorkers, "copy-workers", 0, "Copy new images on this many workers of their own, -workers only hash and write the database (0 copies on -workers)")
+	fs.IntVar(&a.svc.CopyRetries, "copy-retries", defaultCopyRetries, "Retries of a failed copy within the run, 0 leaves it to the next run")
+	fs.DurationVar(&a.svc.RetryDelay, "copy-retry-delay", defaultRetryDelay, "Delay before the first copy retry, doubled on every further retry up to 5m")
+	fs.BoolVar(&a.svc.DropMismatch, "delete-crc-mismatch", false, "Delete copies whose crc32c differs from the source so the next run retries them")
+	fs.BoolVar(&a.svc.Transform, "transform", false, "Re-encode images as JPEG instead of a server-side copy")
+	fs.IntVar(&a.svc.JPEGQuality, "jpeg-quality", jpeg.DefaultQuality, "JPEG quality (1-100) used with -transform")
+	fs.IntVar(&a.svc.ChunkSize, "chunk-size", 0, "Upload chunk size in bytes used with -transform, a multiple of 256KiB (0 keeps the client default)")
+	fs.StringVar(&a.svc.StorageClass, "dst-storage-class", "", "Storage class of copied objects, e.g. NEARLINE (defaults to the bucket's)")
+	fs.StringVar(&a.svc.KMSKey, "kms-key", "", "Cloud KMS key name copied objects are encrypted with (CMEK), projects/P/locations/L/keyRings/R/cryptoKeys/K")
+	fs.BoolVar(&a.svc.KeepMetadata, "preserve-metadata", true, "Carry the source custom metadata over to copied objects")
+	metadata := mapFlag{}
+	a.svc.Metadata = metadata
+	fs.Var(metadata, "metadata", "Custom metadata key=value set on copied objects, overriding source keys (repeatable)")
+	fs.BoolVar(&a.svc.Provenance, "stamp-provenance", false, "Stamp server-side copies with "+sourceBucketKey+", "+sourceObjectKey+", "+runIDKey+" and "+copiedAtKey+" custom metadata")
+	fs.StringVar(&a.svc.SummaryFile, "summary-file", "", "Write the JSON run summary to this path on shutdown (- for stdout)")
+	fs.StringVar(&a.svc.Manifest, "manifest", "", "Local path or gs:// URI of a JSONL manifest of copied objects")
+	fs.StringVar(&a.svc.BigQueryTable, "bigquery-table", "", "Stream processed object events to this project.dataset.table via insertAll (uses ADC)")
+	fs.IntVar(&a.svc.BigQueryBatch, "bigquery-batch", defaultBigQueryBatch, "Events per BigQuery insertAll request")
+}
+
+// routeFlags send the copies of some content types to other dsts.
+func routeFlags(fs *flag.FlagSet, a *cliArgs) {
+	routes := mapFlag{}
+	a.svc.ContentRoutes = routes
+	fs.Var(routes, "route-content-type", "Copy objects of a content type to another dst, type=bucket[/prefix] e.g. image/png=png-bucket/raw (repeatable)")
+}
+
+// stagingFlags store copies under a staging prefix until they are promoted.
+func stagingFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.StringVar(&a.svc.StagingPrefix, "staging-prefix", "", "Copy new images under this dst prefix, e.g. staging, until promote moves them to their final name (empty copies to the final name)")
+}
+
+// promoteFlags configure the promote subcommand.
+func promoteFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.BoolVar(&a.svc.PromoteVerify, "promote-verify", true, "Only promote staged copies whose crc32c matches the stored crc32, disable for -transform copies")
+}
+
+// createDstFlags create a missing dst bucket before a scan.
+func createDstFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.BoolVar(&a.svc.CreateDst, "create-dst", false, "Create the dst bucket on startup when it doesn't exist")
+	fs.StringVar(&a.svc.CreateProject, "create-dst-project", "", "Project the dst bucket is created in (defaults to -dst-project)")
+	fs.StringVar(&a.svc.CreateRegion, "create-dst-location", defaultDstLocation, "Location of a created dst bucket, a region, dual-region or multi-region")
+	fs.StringVar(&a.svc.CreateClass, "create-dst-storage-class", "", "Default storage class of a created dst bucket, e.g. NEARLINE (defaults to STANDARD)")
+}
+
+// checkpointFlags hand a scan over to another process through a local file.
+func checkpointFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.StringVar(&a.svc.Checkpoint, "checkpoint-file", "", "Local file the last handled object is saved to and a scan resumes after on startup, removed once the listing completes")
+	fs.IntVar(&a.svc.CheckEvery, "checkpoint-every", defaultCheckpointEvery, "Number of handled objects between two -checkpoint-file writes, also written on shutdown")
+}
 
-	// ImgDeduper svc options
-	svcOpts := SvcOptions{
-		SrcBucketName: *srcBucketName,
-		DstBucketName: *dstBucketName,
-		Prefix:        *prefix,
-		Limit:         *limit,
+// breakerFlags pause the workers while GCS or the database keeps failing.
+func breakerFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.IntVar(&a.svc.BreakerLimit, "breaker-threshold", 0, "Consecutive GCS or database failures opening a circuit breaker that pauses their calls (0 disables)")
+	fs.DurationVar(&a.svc.BreakerPause, "breaker-cooldown", 30*time.Second, "Pause of an open circuit breaker before a single call probes the dependency again")
+}
+
+// testConnFlags configure the test-connection subcommand.
+func testConnFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.DurationVar(&a.svc.TestTimeout, "test-timeout", defaultTestTimeout, "Time allowed for every dependency to answer")
+}
+
+func reportFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.StringVar(&a.svc.ReportFile, "report-file", "", "Write the report output to this path (- for stdout), required")
+	fs.BoolVar(&a.svc.AcrossBuckets, "dedupe-across-buckets", false, "Only count images stored from other src buckets as duplicates, matched on content hash alone")
+	fs.StringVar(&a.svc.ReportFormat, "report-format", reportCSV, "Report output format: csv or json")
+	fs.BoolVar(&a.svc.DupesOnly, "report-duplicates-only", false, "Report the clusters of stored images sharing a crc32, canonical name and duplicate names, instead of the listed objects")
+	fs.IntVar(&a.svc.SamplePercent, "sample-percent", 0, "Only report a deterministic sample of this percent of the objects and estimate the totals (0 reports all)")
+}
+
+// listOutputFlags configure the list subcommand.
+func listOutputFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.BoolVar(&a.svc.ListDetails, "list-details", false, "Print the size and crc32 after each name, tab separated")
+}
+
+// notificationFlags configure the setup-notifications subcommand.
+func notificationFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.StringVar(&a.svc.NotifyTopic, "notification-topic", "", "Pub/Sub topic src publishes new objects to, projects/P/topics/T, created when absent")
+	fs.StringVar(&a.svc.NotifyPrefix, "notification-prefix", "", "Only notify objects whose name starts with this prefix (empty notifies every object)")
+}
+
+// reconcileFlags configure the reconcile subcommand.
+func reconcileFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.BoolVar(&a.svc.LegacyRows, "reconcile-legacy", false, "Check the rows stamped with the epoch, stored before copies were tracked and assumed copied, instead of the rows whose copy failed")
+}
+
+// gcFlags configure the gc subcommand.
+func gcFlags(fs *flag.FlagSet, a *cliArgs) {
+	fs.StringVar(&a.svc.GCCheck, "gc-check", gcCheckSrc, "Prune rows whose src object (src) or dst copy (dst) no longer exists")
+	fs.BoolVar(&a.svc.GCNullBucket, "gc-null-bucket", false, "Also check the rows stored before their src bucket was recorded, only when every such row came from this src")
+}
+
+// parseCLIArgs parses the subcommand named by the first argument and its
+// flags, scan when the first argument is a flag or missing.
+func parseCLIArgs() (string, string, bool, SvcOptions, DBOptions, StorageOptions, TracingOptions) {
+	args := os.Args[1:]
+	cmd := commands[0]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		found := false
+		for _, c := range commands {
+			if c.name == args[0] {
+				cmd, found = c, true
+			}
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+			printCommands(os.Stderr)
+			os.Exit(exitCodeErr)
+		}
+		args = args[1:]
+	}
+
+	a := cliArgs{svc: SvcOptions{Mode: cmd.name}}
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	for _, register := range cmd.flags {
+		register(fs, &a)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags]\n\n%s\n\n", os.Args[0], cmd.name, cmd.usage)
+		fs.PrintDefaults()
+		if cmd.name == modeScan {
+			fmt.Fprintln(fs.Output())
+			printCommands(fs.Output())
+		}
+	}
+	_ = fs.Parse(args)
+
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "port" {
+			fmt.Fprintln(os.Stderr, "-port is deprecated, use -listen :"+a.port)
+		}
+	})
+	listen, err := listenAddress(a.listen, a.port)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCodeErr)
 	}
-	// db options
-	dbOpts := DBOptions{
-		DBUsername:         *dbUsername,
-		DBPassword:         *dbPassword,
-		DBConnectionString: *dbConnectionString,
+	a.listen = listen
+	lvl, err := logLevel(a.logLevel, a.debug, a.quiet)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCodeErr)
 	}
 
-	return *debug, *port, svcOpts, dbOpts
+	if a.printConfig {
+		if err := printConfig(os.Stdout, a); err != nil {
+			fmt.Fprintf(os.Stderr, "print config: %v\n", err)
+			os.Exit(exitCodeErr)
+		}
+		os.Exit(0)
+	}
+
+	return lvl, a.listen, a.enablePprof, a.svc, a.db, a.storage, a.tracing
+}
+
+// printCommands lists the subcommands.
+func printCommands(w io.Writer) {
+	fmt.Fprintf(w, "Commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-20s %s\n", c.name, c.usage)
+	}
 }
 
 func main() {
 	// args
-	debug, port, svcOpts, dbOpts := parseCLIArgs()
+	lvl, listen, enablePprof, svcOpts, dbOpts, storageOpts, tracingOpts := parseCLIArgs()
+
+	// init container gate, prints nothing but the result
+	if svcOpts.Mode == modeTestConn {
+		os.Exit(testConnection(os.Stdout, svcOpts, dbOpts, storageOpts))
+	}
 
 	// context
 	var ctx context.Context
 	ctx = context.Background()
-	ctx = contextWithLogger(ctx, newLogger(debug))
+	ctx = contextWithLogger(ctx, newLogger(lvl))
 	// todo: WithTimeout terminates the SQL connection after prescribed time. Need to figure out how to keep it alive / reconnect.
 	// ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	// defer cancel()
@@ -90,31 +391,88 @@ func main() {
 		signal.Notify(c, syscall.SIGTERM, os.Interrupt)
 	}()
 
-	client, err := storage.NewClient(ctx)
+	// tracing
+	shutdownTracing, err := initTracing(ctx, tracingOpts)
+	if err != nil {
+		level.Error(l).Log("msg", "failed to initialize tracing", "error", err)
+		os.Exit(exitCodeErr)
+	}
+	flushTracing := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			level.Error(l).Log("msg", "failed to flush traces", "error", err)
+		}
+	}
+
+	client, err := newStorageClient(ctx, storageOpts.Src)
 	if err != nil {
 		level.Error(l).Log("msg", "failed to create storage client", "error", err)
 		panic(1)
 	}
 	defer client.Close()
-	level.Info(l).Log("msg", "storage client created")
+	level.Info(l).Log("msg", "storage client created", "impersonate", storageOpts.Src.ImpersonateSA)
 
-	// database client
-	dsn := fmt.Sprintf("postgresql://%s:%s@%s", dbOpts.DBUsername, dbOpts.DBPassword, dbOpts.DBConnectionString)
-	roach, err := pgx.Connect(ctx, dsn)
-	defer roach.Close(ctx)
-	if err != nil {
-		level.Error(l).Log("msg", "failed to connect database", "error", err)
-		os.Exit(exitCodeErr)
+	// dst client, only when dst needs a different identity
+	dstClient := client
+	if storageOpts.Dst.IsSet() {
+		dstClient, err = newStorageClient(ctx, storageOpts.Dst)
+		if err != nil {
+			level.Error(l).Log("msg", "failed to create dst storage client", "error", err)
+			os.Exit(exitCodeErr)
+		}
+		defer dstClient.Close()
+		level.Info(l).Log("msg", "dst storage client created", "impersonate", storageOpts.Dst.ImpersonateSA)
+	}
+
+	// database client, list and setup-notifications never touch the database
+	var roach *pgxpool.Pool
+	if svcOpts.Mode != modeList && svcOpts.Mode != modeNotify {
+		roach, err = openDatabase(ctx, dbOpts, svcOpts)
+		if err != nil {
+			level.Error(l).Log("msg", "failed to connect database", "error", err)
+			os.Exit(exitCodeErr)
+		}
+		defer roach.Close()
+		level.Info(l).Log("msg", "database connection established")
 	}
-	level.Info(l).Log("msg", "database connection established")
 
 	// main service
-	svc := NewSvc(ctx, client, roach, &svcOpts)
+	// crdb retries forever when set to 0, keep at least one retry
+	if dbOpts.MaxRetries < 1 {
+		dbOpts.MaxRetries = 1
+	}
+	svcCtx := withConnRetries(crdb.WithMaxRetries(ctx, dbOpts.MaxRetries), dbOpts.ConnRetries)
+	svc := NewSvc(svcCtx, client, dstClient, roach, &svcOpts)
+	stopping := make(chan struct{})
+	drained := make(chan bool, 1)
+
+	// bounded runs stop through the same drain path as a signal
+	var deadline <-chan time.Time
+	runtimeTimer := time.NewTimer(svcOpts.MaxRuntime)
+	if svcOpts.MaxRuntime > 0 {
+		deadline = runtimeTimer.C
+	} else {
+		runtimeTimer.Stop()
+	}
+
 	go func() {
-		if err := svc.Start(); err != nil {
+		err := svc.Start()
+		runtimeTimer.Stop()
+		flushTracing()
+		if err != nil {
 			level.Error(l).Log("msg", "service failure", "error", err)
 			os.Exit(exitCodeErr)
 		}
+		// when stopped by a signal, the exit code depends on the drain outcome
+		select {
+		case <-stopping:
+			if !<-drained {
+				level.Warn(l).Log("msg", "service stopped before in-flight objects completed")
+				os.Exit(exitCodeInterrupt)
+			}
+		default:
+		}
 		level.Info(l).Log("msg", "service process completed")
 		os.Exit(exitCodeSuccess)
 	}()
@@ -122,9 +480,17 @@ func main() {
 	// allow context cancelling
 	go func() {
 		select {
-		case <-signalChan: // first signal, cancel context
+		case <-signalChan: // first signal, drain in-flight objects then cancel context
+			close(stopping)
+			drained <- svc.Stop()
+			cancel()
+		case <-deadline:
+			level.Info(l).Log("msg", "max runtime reached, stopping", "max_runtime", svcOpts.MaxRuntime)
+			close(stopping)
+			drained <- svc.Stop()
+			// resume the next pass with -start-after
+			level.Info(l).Log("msg", "checkpoint", "start_after", svc.Stats().Cursor, "shard_index", svcOpts.ShardIndex, "shard_count", svcOpts.ShardCount)
 			cancel()
-			svc.Stop()
 		case <-ctx.Done():
 		}
 		<-signalChan // second signal, hard exit
@@ -132,7 +498,46 @@ func main() {
 	}()
 
 	// metrics and health
-	startWebServer(ctx, svc, done, port)
+	startWebServer(ctx, svc, done, listen, enablePprof)
 	level.Info(l).Log("exit", <-done)
-	roach.Close(ctx)
+	if roach != nil {
+		roach.Close()
+	}
+}
+
+// openDatabase creates the connection pool and checks the database is
+// reachable.
+func openDatabase(ctx context.Context, dbOpts DBOptions, svcOpts SvcOptions) (*pgxpool.Pool, error) {
+	if err := validateDBTLS(dbOpts); err != nil {
+		return nil, err
+	}
+	dsn := fmt.Sprintf("postgresql://%s:%s@%s", dbOpts.DBUsername, dbOpts.DBPassword, dbOpts.DBConnectionString)
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parse connection string: %w", err)
+	}
+	if err := applyDBTLS(&poolConfig.ConnConfig.Config, dbOpts); err != nil {
+		return nil, err
+	}
+	// fail slow queries fast so the error path kicks in
+	if dbOpts.StatementTimeout > 0 {
+		poolConfig.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(dbOpts.StatementTimeout.Milliseconds(), 10)
+	}
+	// reports must never write, enforce it on the connection
+	if svcOpts.Mode == modeReport {
+		poolConfig.ConnConfig.RuntimeParams["default_transaction_read_only"] = "on"
+	}
+	// one connection per worker so workers never wait on each other
+	if conns := int32(svcOpts.Workers + svcOpts.CopyWorkers); conns > poolConfig.MaxConns {
+		poolConfig.MaxConns = conns
+	}
+	roach, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := roach.Ping(ctx); err != nil {
+		roach.Close()
+		return nil, err
+	}
+	return roach, nil
 }
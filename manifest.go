@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const gcsScheme = "gs://"
+
+// manifestEntry is a single line of the copy manifest.
+type manifestEntry struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CRC32     uint32    `json:"crc32"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Manifest records every object copied during a run as JSONL.
+// Local targets are appended to directly. GCS targets are buffered in a temp
+// file and uploaded as a single object when the manifest is closed.
+type Manifest struct {
+	mu     sync.Mutex
+	client *storage.Client
+	bucket string
+	object string
+	file   *os.File
+	w      *bufio.Writer
+}
+
+// parseGCSURI splits a gs://bucket/object URI into its bucket and object name.
+func parseGCSURI(uri string) (string, string, error) {
+	p := strings.SplitN(strings.TrimPrefix(uri, gcsScheme), "/", 2)
+	if len(p) != 2 || p[0] == "" || p[1] == "" {
+		return "", "", fmt.Errorf("invalid gcs uri %q, expected gs://bucket/object", uri)
+	}
+	return p[0], p[1], nil
+}
+
+// NewManifest opens the manifest target, a local path or gs:// URI.
+func NewManifest(client *storage.Client, target string) (*Manifest, error) {
+	m := &Manifest{client: client}
+
+	var err error
+	if strings.HasPrefix(target, gcsScheme) {
+		if m.bucket, m.object, err = parseGCSURI(target); err != nil {
+			return nil, err
+		}
+		m.file, err = os.CreateTemp("", "manifest-*.jsonl")
+	} else {
+		m.file, err = os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.w = bufio.NewWriter(m.file)
+	return m, nil
+}
+
+// Emit appends a copied object to the manifest, other events are ignored.
+func (m *Manifest) Emit(ev ObjectEvent) error {
+	if ev.Status != "copy" {
+		return nil
+	}
+	b, err := json.Marshal(manifestEntry{
+		Name:      ev.Name,
+		Size:      ev.Size,
+		CRC32:     ev.CRC32,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.w.Write(b); err != nil {
+		return err
+	}
+	return m.w.WriteByte('\n')
+}
+
+// Close flushes buffered entries and, for GCS targets, uploads the manifest.
+func (m *Manifest) Close(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.w.Flush(); err != nil {
+		m.file.Close()
+		return err
+	}
+	if m.bucket == "" {
+		return m.file.Close()
+	}
+
+	defer os.Remove(m.file.Name())
+	defer m.file.Close()
+	if _, err := m.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	w := m.client.Bucket(m.bucket).Object(m.object).NewWriter(ctx)
+	w.ContentType = "application/x-ndjson"
+	if _, err := io.Copy(w, m.file); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
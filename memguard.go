@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// memCheckInterval is how often the heap is checked against -max-memory,
+// runtime.ReadMemStats briefly stops the world.
+const memCheckInterval = 2 * time.Second
+
+// memRecovery is the fraction of -max-memory the heap has to drop below
+// before a worker is given back, so the limit doesn't flap.
+const memRecovery = 0.8
+
+// memoryGuard limits the workers processing an object at once while the heap
+// is above max. Every check over max halves the workers allowed, down to one
+// so the run keeps moving, and every check below the recovery mark gives one
+// back. A nil guard allows every worker.
+type memoryGuard struct {
+	max     uint64
+	workers int
+	gauge   prometheus.Gauge
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	allowed int
+	active  int
+}
+
+// newMemoryGuard returns the guard of workers, nil when max disables it.
+// max also becomes the soft memory limit of the runtime, so the GC works
+// harder before the workers are cut.
+func newMemoryGuard(max int64, workers int, gauge prometheus.Gauge) *memoryGuard {
+	gauge.Set(float64(workers))
+	if max <= 0 {
+		return nil
+	}
+	debug.SetMemoryLimit(max)
+	g := &memoryGuard{max: uint64(max), workers: workers, gauge: gauge, allowed: workers}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// acquire blocks until the worker may process an object.
+func (g *memoryGuard) acquire() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	for g.active >= g.allowed {
+		g.cond.Wait()
+	}
+	g.active++
+	g.mu.Unlock()
+}
+
+// release ends the object acquire was called for.
+func (g *memoryGuard) release() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+	g.cond.Signal()
+}
+
+// run checks the heap until stop is closed.
+func (g *memoryGuard) run(ctx context.Context, stop <-chan struct{}) {
+	if g == nil {
+		return
+	}
+	t := time.NewTicker(memCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			g.check(ctx, m.HeapAlloc)
+		}
+	}
+}
+
+// check adapts the workers allowed to the heap size.
+func (g *memoryGuard) check(ctx context.Context, heap uint64) {
+	l := loggerFromContext(ctx)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch {
+	case heap > g.max && g.allowed > 1:
+		g.allowed /= 2
+		level.Warn(l).Log("msg", "heap above max memory, reducing workers", "heap", heap, "max_memory", g.max, "workers", g.allowed)
+	case float64(heap) < memRecovery*float64(g.max) && g.allowed < g.workers:
+		g.allowed++
+		if g.allowed == g.workers {
+			level.Info(l).Log("msg", "heap recovered, all workers resumed", "heap", heap, "workers", g.allowed)
+		}
+		g.cond.Broadcast()
+	default:
+		return
+	}
+	g.gauge.Set(float64(g.allowed))
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-kit/log/level"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// defaultPushJob is the job label of metrics pushed to the Pushgateway.
+const defaultPushJob = "go-gcp-img-meta"
+
+// defaultMetricsNamespace prefixes every metric unless -metrics-namespace is set.
+const defaultMetricsNamespace = "meta"
+
+// metrics are the service metrics, built once per service so the namespace and
+// subsystem are configurable.
+type metrics struct {
+	objectProcessed *prometheus.CounterVec
+	objectVerified  *prometheus.CounterVec
+	objectErrors    *prometheus.CounterVec
+	objectTimeouts  prometheus.Counter
+	copyCRCMismatch prometheus.Counter
+	listPageRetries prometheus.Counter
+	dbConnRetries   *prometheus.CounterVec
+	workersActive   prometheus.Gauge
+	workersLimit    prometheus.Gauge
+	queueDepth      prometheus.Gauge
+	queueCapacity   prometheus.Gauge
+	processingLag   prometheus.Gauge
+	copyRetryQueue  prometheus.Gauge
+	uploadBytes     prometheus.Counter
+	uploadRetries   prometheus.Counter
+	dbRepairs       prometheus.Counter
+	batchChecks     prometheus.Counter
+	lookupsSkipped  prometheus.Counter
+	crcComputed     prometheus.Counter
+	dbPaused        prometheus.Gauge
+	dbPauses        prometheus.Counter
+	breakerState    *prometheus.GaugeVec
+	sectionRatio    *prometheus.GaugeVec
+	breakerTrips    *prometheus.CounterVec
+}
+
+// newMetrics builds the metrics and registers them with reg, a nil reg leaves
+// them unregistered.
+func newMetrics(reg prometheus.Registerer, namespace, subsystem string) *metrics {
+	f := promauto.With(reg)
+	return &metrics{
+		objectProcessed: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "objects_processed",
+				Help:      "Total objects processed",
+			},
+			[]string{"status", "operation", "section"},
+		),
+		objectVerified: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "objects_verified",
+				Help:      "Total objects verified against the destination bucket",
+			},
+			[]string{"result"},
+		),
+		objectErrors: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "object_errors_total",
+				Help:      "Number of failed objects by failure class",
+			},
+			[]string{"class"},
+		),
+		objectTimeouts: f.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "object_timeouts_total",
+				Help:      "Number of objects abandoned after -object-timeout",
+			},
+		),
+		copyCRCMismatch: f.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "copy_crc_mismatch_total",
+				Help:      "Total copies whose destination crc32c differs from the source",
+			},
+		),
+		listPageRetries: f.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "list_page_retries_total",
+				Help:      "Number of bucket listing page fetches retried after a failure",
+			},
+		),
+		dbConnRetries: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "db_conn_retries_total",
+				Help:      "Number of database operations retried after a connection failure",
+			},
+			[]string{"operation"},
+		),
+		workersActive: f.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "workers_active",
+				Help:      "Number of workers currently processing an object",
+			},
+		),
+		workersLimit: f.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "workers_allowed",
+				Help:      "Number of workers allowed to process objects, lowered while the heap is above -max-memory",
+			},
+		),
+		queueDepth: f.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "queue_depth",
+				Help:      "Number of listed objects waiting for a worker",
+			},
+		),
+		queueCapacity: f.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "queue_capacity",
+				Help:      "Number of listed objects the dispatch queue holds before listing blocks",
+			},
+		),
+		processingLag: f.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "processing_lag",
+				Help:      "Number of listed objects not yet processed, queued or in progress",
+			},
+		),
+		copyRetryQueue: f.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "copy_retry_queue",
+				Help:      "Number of failed copies waiting for a retry",
+			},
+		),
+		uploadBytes: f.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "upload_bytes_total",
+				Help:      "Bytes of transformed images uploaded to dst",
+			},
+		),
+		uploadRetries: f.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "upload_retries_total",
+				Help:      "Number of transformed image uploads restarted after a retryable failure",
+			},
+		),
+		dbRepairs: f.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "db_repair_total",
+				Help:      "Rows inserted for objects found in dst without a row, see -skip-existing",
+			},
+		),
+		batchChecks: f.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "db_batch_checks_total",
+				Help:      "Batches of listed objects whose crc32 were looked up with one query, see -db-batch-check",
+			},
+		),
+		lookupsSkipped: f.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "db_lookups_skipped_total",
+				Help:      "Dedup lookups skipped because the batch check found the object's crc32 unstored",
+			},
+		),
+		crcComputed: f.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "crc32c_computed_total",
+				Help:      "Objects listed without a crc32c whose crc32c was computed by downloading them, see -missing-crc32c",
+			},
+		),
+		dbPaused: f.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "db_paused",
+				Help:      "1 while the scan is paused waiting for the database, see -drain-on-db-error",
+			},
+		),
+		dbPauses: f.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "db_pauses_total",
+				Help:      "Scan pauses for a database outage, see -drain-on-db-error",
+			},
+		),
+		breakerState: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "circuit_breaker_state",
+				Help:      "Circuit breaker state by dependency, 0 closed, 1 half-open, 2 open",
+			},
+			[]string{"dependency"},
+		),
+		sectionRatio: f.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "section_duplicate_ratio",
+				Help:      "Share of duplicates among the copied and duplicate objects of a section, see -section-stats",
+			},
+			[]string{"section"},
+		),
+		breakerTrips: f.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "circuit_breaker_trips_total",
+				Help:      "Number of times a circuit breaker opened, by dependency",
+			},
+			[]string{"dependency"},
+		),
+	}
+}
+
+// registerPoolMetrics registers metrics read from the database pool stats,
+// the acquire wait shows whether the pool is too small for the workers.
+func registerPoolMetrics(reg prometheus.Registerer, namespace, subsystem string, pool *pgxpool.Pool) {
+	f := promauto.With(reg)
+	f.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "db_acquire_wait_seconds_total",
+			Help:      "Total time spent acquiring database connections from the pool",
+		},
+		func() float64 { return pool.Stat().AcquireDuration().Seconds() },
+	)
+	f.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "db_acquires_total",
+			Help:      "Number of database connections acquired from the pool",
+		},
+		func() float64 { return float64(pool.Stat().AcquireCount()) },
+	)
+	f.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "db_empty_acquires_total",
+			Help:      "Number of acquires that waited for a free database connection",
+		},
+		func() float64 { return float64(pool.Stat().EmptyAcquireCount()) },
+	)
+	f.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "db_conns_acquired",
+			Help:      "Number of database connections currently acquired",
+		},
+		func() float64 { return float64(pool.Stat().AcquiredConns()) },
+	)
+}
+
+type ctxMetrics struct{}
+
+// contextWithMetrics adds m to ctx for code without access to the service,
+// e.g. the database helpers.
+func contextWithMetrics(ctx context.Context, m *metrics) context.Context {
+	return context.WithValue(ctx, ctxMetrics{}, m)
+}
+
+// metricsFromContext returns the service metrics, unregistered ones when ctx
+// carries none.
+func metricsFromContext(ctx context.Context) *metrics {
+	if m, ok := ctx.Value(ctxMetrics{}).(*metrics); ok {
+		return m
+	}
+	return newMetrics(nil, defaultMetricsNamespace, "")
+}
+
+// pushMetrics pushes the final metric values to the Pushgateway, if one is
+// configured, so short-lived runs aren't lost between scrapes.
+func (svc *ImgDeduper) pushMetrics() {
+	if svc.Pushgateway == "" {
+		return
+	}
+	l := loggerFromContext(svc.Context)
+
+	err := push.New(svc.Pushgateway, svc.PushJob).
+		Gatherer(prometheus.DefaultGatherer).
+		Push()
+	if err != nil {
+		level.Error(l).Log("msg", "failed to push metrics", "url", svc.Pushgateway, "job", svc.PushJob, "error", err)
+		return
+	}
+	level.Info(l).Log("msg", "metrics pushed", "url", svc.Pushgateway, "job", svc.PushJob)
+}
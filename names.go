@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"google.golang.org/api/iterator"
+)
+
+// objectSource yields the objects to process, iterator.Done ends it.
+type objectSource interface {
+	Next() (*storage.ObjectAttrs, error)
+}
+
+// namesIterator yields the attrs of the objects named in a newline-delimited
+// list instead of listing the bucket. Names missing from src are counted and
+// skipped.
+type namesIterator struct {
+	svc     *ImgDeduper
+	src     *storage.BucketHandle
+	r       io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// newNamesIterator opens a local path or gs:// URI listing object names.
+func newNamesIterator(svc *ImgDeduper, src *storage.BucketHandle, path string) (*namesIterator, error) {
+	ctx := svc.Context
+	var r io.ReadCloser
+	if strings.HasPrefix(path, gcsScheme) {
+		bucket, object, err := parseGCSURI(path)
+		if err != nil {
+			return nil, err
+		}
+		if r, err = svc.Client.Bucket(bucket).Object(object).NewReader(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+
+	return &namesIterator{
+		svc:     svc,
+		src:     src,
+		r:       r,
+		scanner: bufio.NewScanner(r),
+	}, nil
+}
+
+// srcAttrs looks name up in src, over http when -src-url is set.
+func (svc *ImgDeduper) srcAttrs(ctx context.Context, src *storage.BucketHandle, name string) (*storage.ObjectAttrs, error) {
+	if svc.SrcURL != "" {
+		return httpSourceAttrs(ctx, svc.srcURL(name), name)
+	}
+	var attrs *storage.ObjectAttrs
+	err := svc.gcs.do(ctx, func() (err error) {
+		attrs, err = src.Object(name).Attrs(ctx)
+		return err
+	})
+	return attrs, err
+}
+
+func (it *namesIterator) Next() (*storage.ObjectAttrs, error) {
+	l := loggerFromContext(it.svc.Context)
+
+	for it.scanner.Scan() {
+		name := strings.TrimSpace(it.scanner.Text())
+		if name == "" {
+			continue
+		}
+
+		attrs, err := it.svc.srcAttrs(it.svc.Context, it.src, name)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			level.Error(l).Log("msg", "object not found in src", "name", name)
+			it.svc.countObject("error", "not_found", objectSection(name))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return attrs, nil
+	}
+
+	if err := it.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, iterator.Done
+}
+
+// Close closes the underlying names file.
+func (it *namesIterator) Close() error {
+	return it.r.Close()
+}
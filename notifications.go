@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"google.golang.org/api/googleapi"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// pubsubPublisher is the role the GCS service agent needs on the topic.
+const pubsubPublisher = "roles/pubsub.publisher"
+
+// topicName matches a Pub/Sub topic resource name.
+var topicName = regexp.MustCompile(`^projects/([^/]+)/topics/([^/]+)$`)
+
+// notificationSetup is the configuration printed by setup-notifications.
+type notificationSetup struct {
+	Bucket         string   `json:"bucket"`
+	Topic          string   `json:"topic"`
+	TopicCreated   bool     `json:"topic_created"`
+	Publisher      string   `json:"publisher"`
+	PublisherAdded bool     `json:"publisher_added"`
+	ID             string   `json:"notification_id"`
+	EventTypes     []string `json:"event_types"`
+	Prefix         string   `json:"object_name_prefix"`
+	PayloadFormat  string   `json:"payload_format"`
+	Created        bool     `json:"notification_created"`
+}
+
+// setupNotifications makes the src bucket publish an event to -notification-topic
+// for every object finalized under -notification-prefix. The topic is created
+// when absent and the bucket's GCS service agent is granted publish on it.
+// Every step keeps what already exists, so it is safe to run again, and the
+// resulting configuration is printed as JSON to stdout.
+func (svc *ImgDeduper) setupNotifications(src *storage.BucketHandle) error {
+	ctx := svc.Context
+	l := loggerFromContext(ctx)
+
+	m := topicName.FindStringSubmatch(svc.NotifyTopic)
+	if m == nil {
+		return fmt.Errorf("notification topic %q, expected projects/P/topics/T", svc.NotifyTopic)
+	}
+	setup := notificationSetup{Bucket: svc.SrcBucketName, Topic: svc.NotifyTopic, Prefix: svc.NotifyPrefix}
+
+	ps, err := pubsub.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	topics := ps.Projects.Topics
+	if setup.TopicCreated, err = ensureTopic(ctx, topics, svc.NotifyTopic); err != nil {
+		return fmt.Errorf("topic %s: %w", svc.NotifyTopic, err)
+	}
+	level.Info(l).Log("msg", "notification topic", "topic", svc.NotifyTopic, "created", setup.TopicCreated)
+
+	// GCS publishes as the service agent of the bucket's project
+	attrs, err := src.Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("src bucket %s: %w", svc.SrcBucketName, err)
+	}
+	agent, err := svc.Client.ServiceAccount(ctx, fmt.Sprint(attrs.ProjectNumber))
+	if err != nil {
+		return fmt.Errorf("gcs service agent: %w", err)
+	}
+	setup.Publisher = "serviceAccount:" + agent
+	if setup.PublisherAdded, err = grantPublisher(ctx, topics, svc.NotifyTopic, setup.Publisher); err != nil {
+		return fmt.Errorf("grant %s on %s: %w", pubsubPublisher, svc.NotifyTopic, err)
+	}
+	level.Info(l).Log("msg", "notification publisher", "member", setup.Publisher, "added", setup.PublisherAdded)
+
+	n, created, err := ensureNotification(ctx, src, m[1], m[2], svc.NotifyPrefix)
+	if err != nil {
+		return fmt.Errorf("bucket notification: %w", err)
+	}
+	setup.ID, setup.EventTypes, setup.PayloadFormat, setup.Created = n.ID, n.EventTypes, n.PayloadFormat, created
+	level.Info(l).Log("msg", "bucket notification", "bucket", svc.SrcBucketName, "id", n.ID, "created", created)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(setup)
+}
+
+// ensureTopic creates the topic name unless it exists, and reports whether it
+// was created.
+func ensureTopic(ctx context.Context, topics *pubsub.ProjectsTopicsService, name string) (bool, error) {
+	_, err := topics.Get(name).Context(ctx).Do()
+	if err == nil {
+		return false, nil
+	}
+	if !isAPIStatus(err, http.StatusNotFound) {
+		return false, err
+	}
+	_, err = topics.Create(name, &pubsub.Topic{}).Context(ctx).Do()
+	// created concurrently since the lookup
+	if isAPIStatus(err, http.StatusConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// grantPublisher adds member to the publishers of the topic name, and
+// reports whether it was added. The policy etag fails a concurrent change.
+func grantPublisher(ctx context.Context, topics *pubsub.ProjectsTopicsService, name, member string) (bool, error) {
+	p, err := topics.GetIamPolicy(name).Context(ctx).Do()
+	if err != nil {
+		return false, err
+	}
+	var binding *pubsub.Binding
+	for _, b := range p.Bindings {
+		if b.Role == pubsubPublisher && b.Condition == nil {
+			binding = b
+			break
+		}
+	}
+	if binding == nil {
+		binding = &pubsub.Binding{Role: pubsubPublisher}
+		p.Bindings = append(p.Bindings, binding)
+	}
+	for _, m := range binding.Members {
+		if m == member {
+			return false, nil
+		}
+	}
+	binding.Members = append(binding.Members, member)
+	_, err = topics.SetIamPolicy(name, &pubsub.SetIamPolicyRequest{Policy: p}).Context(ctx).Do()
+	return err == nil, err
+}
+
+// ensureNotification returns the bucket's OBJECT_FINALIZE notification to the
+// topic for prefix, adding it when there is none, and reports whether it was
+// added.
+func ensureNotification(ctx context.Context, b *storage.BucketHandle, project, topic, prefix string) (*storage.Notification, bool, error) {
+	existing, err := b.Notifications(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, n := range existing {
+		if n.TopicProjectID == project && n.TopicID == topic && n.ObjectNamePrefix == prefix &&
+			n.PayloadFormat == storage.JSONPayload && notifiesFinalize(n) {
+			return n, false, nil
+		}
+	}
+	n, err := b.AddNotification(ctx, &storage.Notification{
+		TopicProjectID:   project,
+		TopicID:          topic,
+		EventTypes:       []string{storage.ObjectFinalizeEvent},
+		ObjectNamePrefix: prefix,
+		PayloadFormat:    storage.JSONPayload,
+	})
+	return n, err == nil, err
+}
+
+// notifiesFinalize reports whether n fires on finalized objects, a
+// notification without event types fires on every event.
+func notifiesFinalize(n *storage.Notification) bool {
+	if len(n.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range n.EventTypes {
+		if strings.EqualFold(t, storage.ObjectFinalizeEvent) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAPIStatus reports whether err is a Google API error with the HTTP status code.
+func isAPIStatus(err error, code int) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
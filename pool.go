@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"google.golang.org/api/iterator"
+)
+
+// job is a listed object, or a failed copy due for a retry.
+type job struct {
+	attrs *storage.ObjectAttrs
+	retry *copyRetry
+}
+
+// forEachObject drains the object source, handing each object to fn on
+// svc.Workers goroutines. The dispatch queue holds svc.QueueSize objects, the
+// lister blocks while it is full. Listing stops when the scan limit is reached, the
+// service is stopped or the iterator fails. Failed copies queued by fn are
+// retried on the same workers, or on the copy stage with svc.CopyWorkers. It
+// returns once all dispatched objects have been handled and no retry is left.
+// With -shard-count only the objects of the replica's shard are handled.
+// With -max-memory fewer workers take objects while the heap is above it.
+// With -checkpoint-file the handled objects are checkpointed as they go.
+// With -drain-on-db-error the listing holds while the database is unavailable.
+// fn is passed the worker's context, which carries its pinned database
+// connection with -db-pin-conns.
+func (svc *ImgDeduper) forEachObject(b objectSource, fn func(context.Context, *storage.ObjectAttrs)) error {
+	l := loggerFromContext(svc.Context)
+
+	workers := svc.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	queueSize := svc.QueueSize
+	if queueSize < 1 {
+		queueSize = 2 * workers
+	}
+
+	b = svc.shardObjects(b)
+
+	jobs := make(chan job, queueSize)
+	svc.metrics.queueCapacity.Set(float64(queueSize))
+	if svc.CopyWorkers > 0 {
+		svc.stage = svc.startCopyStage(svc.CopyWorkers, queueSize)
+		defer func() { svc.stage = nil }()
+	}
+	guard := newMemoryGuard(svc.MaxMemory, workers, svc.metrics.workersLimit)
+	stopGuard := make(chan struct{})
+	defer close(stopGuard)
+	go guard.run(svc.Context, stopGuard)
+
+	var wg, listed sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := svc.Context
+			if svc.PinConns && svc.Roach != nil {
+				c := &pinnedConn{pool: svc.Roach}
+				defer c.release()
+				ctx = contextWithConn(ctx, c)
+			}
+			for j := range jobs {
+				guard.acquire()
+				svc.metrics.queueDepth.Set(float64(len(jobs)))
+				svc.metrics.workersActive.Inc()
+				if j.retry != nil {
+					svc.retryCopy(ctx, j.retry)
+					svc.retries.finish()
+				} else {
+					fn(ctx, j.attrs)
+					// objects abandoned by a cancelled run aren't done
+					if svc.Context.Err() == nil {
+						svc.progress.handled(j.attrs.Name)
+					}
+					svc.stats.handled.Add(1)
+					svc.metrics.processingLag.Set(float64(svc.stats.lag()))
+					listed.Done()
+				}
+				svc.metrics.workersActive.Dec()
+				guard.release()
+			}
+		}()
+	}
+
+	// retries share the dispatch queue with listed objects, or with the
+	// handed over copies with -copy-workers
+	dispatch := func(r *copyRetry) { jobs <- job{retry: r} }
+	if svc.stage != nil {
+		dispatch = func(r *copyRetry) { svc.stage.jobs <- &copyJob{retry: r} }
+	}
+	stopRetries := make(chan struct{})
+	retriesDone := make(chan struct{})
+	go func() {
+		defer close(retriesDone)
+		svc.retries.run(stopRetries, dispatch)
+	}()
+	defer func() {
+		svc.metrics.workersActive.Set(0)
+		svc.metrics.queueDepth.Set(0)
+	}()
+
+	var err error
+	exhausted := false
+	for idx := 1; svc.Ready.Load(); idx++ {
+		// limit the objects processed by count
+		if svc.Limit != 0 && idx > svc.Limit {
+			level.Info(l).Log("msg", "limit reached", "limit", svc.Limit)
+			break
+		}
+
+		// hold the listing while the database is unavailable, the objects
+		// already queued would only pile up behind the paused workers
+		if err := svc.pause.wait(svc.Context); err != nil {
+			break
+		}
+
+		// get next object
+		var attrs *storage.ObjectAttrs
+		attrs, err = b.Next()
+		if err == iterator.Done {
+			err = nil
+			exhausted = true
+			break
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrListing, err)
+			level.Error(l).Log("msg", "failed to get next bucket object", "error", err)
+			break
+		}
+
+		svc.stats.setCursor(attrs.Name)
+		svc.progress.listed(attrs.Name)
+		listed.Add(1)
+		svc.stats.listed.Add(1)
+		svc.metrics.processingLag.Set(float64(svc.stats.lag()))
+		jobs <- job{attrs: attrs}
+		svc.metrics.queueDepth.Set(float64(len(jobs)))
+	}
+
+	// listed objects and their handed over copies may still queue retries
+	// until they are all handled
+	listed.Wait()
+	if svc.stage != nil {
+		svc.stage.wait()
+	}
+	svc.waitRetries()
+	close(stopRetries)
+	<-retriesDone
+	close(jobs)
+	wg.Wait()
+	if svc.stage != nil {
+		svc.stage.stop()
+	}
+	svc.progress.finish(exhausted)
+	return err
+}
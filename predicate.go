@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// copyPredicate selects the objects a scan stores and copies, beyond the
+// listing's prefix and glob. Zero fields don't filter.
+type copyPredicate struct {
+	minSize  int64
+	since    time.Time
+	until    time.Time
+	sections map[string]bool
+}
+
+func newCopyPredicate(o *SvcOptions) copyPredicate {
+	p := copyPredicate{minSize: o.MinSize, since: o.UpdatedSince, until: o.UpdatedUntil}
+	if len(o.Sections) > 0 {
+		p.sections = make(map[string]bool, len(o.Sections))
+		for _, s := range o.Sections {
+			p.sections[s] = true
+		}
+	}
+	return p
+}
+
+// needsUpdated reports whether the predicate reads the Updated attr.
+func (p copyPredicate) needsUpdated() bool {
+	return !p.since.IsZero() || !p.until.IsZero()
+}
+
+// match reports whether the object of section passes every filter, and
+// otherwise the first filter it fails.
+func (p copyPredicate) match(attrs *storage.ObjectAttrs, section string) (string, bool) {
+	switch {
+	case p.minSize > 0 && attrs.Size < p.minSize:
+		return fmt.Sprintf("size %d below %d", attrs.Size, p.minSize), false
+	case !p.since.IsZero() && attrs.Updated.Before(p.since):
+		return "updated before " + p.since.Format(time.RFC3339), false
+	case !p.until.IsZero() && !attrs.Updated.Before(p.until):
+		return "updated after " + p.until.Format(time.RFC3339), false
+	case p.sections != nil && !p.sections[section]:
+		return "section not selected", false
+	}
+	return "", true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+)
+
+// preflightCheck is a set of permissions an identity needs on a bucket.
+type preflightCheck struct {
+	desc   string
+	bucket *storage.BucketHandle
+	name   string
+	perms  []string
+	role   string
+}
+
+// preflight verifies the src and dst identities hold the permissions a copy
+// needs before any object is processed. The server-side copy runs as the dst
+// identity, so it also needs read access to src.
+func (svc *ImgDeduper) preflight(ctx context.Context, src, dst *storage.BucketHandle) error {
+	l := loggerFromContext(ctx)
+
+	checks := []preflightCheck{
+		{
+			desc:   "src identity on src bucket",
+			bucket: src,
+			name:   svc.SrcBucketName,
+			perms:  []string{"storage.objects.list", "storage.objects.get"},
+			role:   "roles/storage.objectViewer",
+		},
+		{
+			desc:   "dst identity on dst bucket",
+			bucket: dst,
+			name:   svc.DstBucketName,
+			perms:  []string{"storage.objects.create", "storage.objects.get"},
+			role:   "roles/storage.objectCreator and roles/storage.objectViewer",
+		},
+		{
+			desc:   "dst identity on src bucket",
+			bucket: svc.DstClient.Bucket(svc.SrcBucketName),
+			name:   svc.SrcBucketName,
+			perms:  []string{"storage.objects.get"},
+			role:   "roles/storage.objectViewer",
+		},
+	}
+
+	// src is read over http, the identities need no access to it
+	if svc.SrcURL != "" {
+		checks = checks[1:2]
+	}
+
+	var failed []string
+	for _, c := range checks {
+		granted, err := c.bucket.IAM().TestPermissions(ctx, c.perms)
+		if err != nil {
+			return fmt.Errorf("preflight %s: %w", c.desc, err)
+		}
+		if missing := missingPermissions(c.perms, granted); len(missing) > 0 {
+			level.Error(l).Log("msg", "preflight failed", "check", c.desc, "bucket", c.name, "missing", strings.Join(missing, ","), "hint", "grant "+c.role+" on gs://"+c.name)
+			failed = append(failed, c.desc)
+			continue
+		}
+		level.Debug(l).Log("msg", "preflight passed", "check", c.desc, "bucket", c.name)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("preflight failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func missingPermissions(want, granted []string) []string {
+	has := make(map[string]bool, len(granted))
+	for _, p := range granted {
+		has[p] = true
+	}
+	var missing []string
+	for _, p := range want {
+		if !has[p] {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
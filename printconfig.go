@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// effectiveConfig is the resolved configuration printed by -print-config.
+type effectiveConfig struct {
+	Service SvcOptions     `json:"service"`
+	DB      DBOptions      `json:"db"`
+	Storage StorageOptions `json:"storage"`
+	Tracing TracingOptions `json:"tracing"`
+}
+
+// printConfig writes the resolved configuration as JSON with its secrets
+// redacted: the database password, and the URLs that carry a token in their
+// path or query. Credential files are printed by path, they are never read.
+func printConfig(w io.Writer, a cliArgs) error {
+	c := effectiveConfig{Service: a.svc, DB: a.db, Storage: a.storage, Tracing: a.tracing}
+	if c.DB.DBPassword != "" {
+		c.DB.DBPassword = redacted
+	}
+	c.DB.DBConnectionString = redactConnString(c.DB.DBConnectionString)
+	c.Service = c.Service.redacted()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(c)
+}
+
+// redacted returns o with the URLs that carry a token redacted, as it is
+// printed, recorded in the runs table and written to the summary file.
+func (o SvcOptions) redacted() SvcOptions {
+	o.WebhookURL = redactURL(o.WebhookURL)
+	o.SrcURL = redactURL(o.SrcURL)
+	o.Pushgateway = redactURL(o.Pushgateway)
+	return o
+}
+
+// redactURL keeps the scheme and host of u, its user info, path and query
+// are replaced.
+func redactURL(u string) string {
+	if u == "" {
+		return ""
+	}
+	p, err := url.Parse(u)
+	if err != nil || p.Host == "" {
+		return redacted
+	}
+	if p.User == nil && p.Path == "" && p.RawQuery == "" {
+		return u
+	}
+	return p.Scheme + "://" + p.Host + "/" + redacted
+}
+
+// redactConnString redacts the password parameter of a host/db?params
+// connection string.
+func redactConnString(cs string) string {
+	host, query, ok := strings.Cut(cs, "?")
+	if !ok {
+		return cs
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return host + "?" + redacted
+	}
+	if _, ok := params["password"]; !ok {
+		return cs
+	}
+	params.Set("password", redacted)
+	return host + "?" + params.Encode()
+}
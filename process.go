@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// processImage dedups and copies a listed object. With -drain-on-db-error an
+// object failed by a database outage before any copy is returned unfinished
+// with the outage, to be processed again once the database answers.
+func (svc *ImgDeduper) processImage(ctx context.Context, src, dst *storage.BucketHandle, attrs *storage.ObjectAttrs) (outage error) {
+	roach := svc.Roach
+	// tag every log line of the object, db and copy helpers log through ctx
+	ctx = contextWithRequestID(ctx, newRequestID())
+	l := loggerFromContext(ctx)
+	errLog := svc.errLogger(ctx)
+	s := objectSection(attrs.Name)
+	// taken up front so skipped objects don't linger in the set
+	unstored := svc.unstored.take(attrs.Name)
+	count := 0
+	original := ""
+	status := "skip"
+	var failure error
+
+	// a copy handed to the copy stage is finished there, see stageCopy
+	handedOff := false
+
+	// trace the object pipeline, status is tagged once processing ends
+	// abandon pathological objects so they can't stall the worker
+	cancel := context.CancelFunc(func() {})
+	if svc.ObjectTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, svc.ObjectTimeout)
+	}
+
+	ctx, span := tracer.Start(ctx, "processImage", trace.WithAttributes(
+		attribute.String("name", attrs.Name),
+		attribute.Int64("size", attrs.Size),
+		attribute.String("req_id", requestIDFromContext(ctx)),
+	))
+	defer func() {
+		if handedOff {
+			return
+		}
+		// an object left for a retry after a database outage isn't finished
+		if outage != nil {
+			span.End()
+		} else {
+			svc.finishObject(ctx, span, attrs, status, original, failure)
+		}
+		cancel()
+	}()
+
+	// skip excluded paths before any db or storage work
+	if pattern, ok := svc.excluded(attrs.Name); ok {
+		status = "skip_excluded"
+		svc.countObject("success", status, s)
+		level.Debug(l).Log("msg", "image", "section", s, "name", attrs.Name, "exclude", pattern, "status", status)
+		return
+	}
+
+	// skip objects ruled out by the copy predicate before any db work
+	if reason, ok := svc.predicate.match(attrs, s); !ok {
+		status = "skip_predicate"
+		svc.countObject("success", status, s)
+		level.Debug(l).Log("msg", "image", "section", s, "name", attrs.Name, "reason", reason, "status", status)
+		return
+	}
+
+	// wait for a free slot in this object's section
+	if err := svc.sections.acquire(ctx, s); err != nil {
+		failure = err
+		level.Error(errLog).Log("msg", "failed to acquire section slot", "section", s, "name", attrs.Name, "error", failure)
+		return
+	}
+	defer func() {
+		if !handedOff {
+			svc.sections.release(s)
+		}
+	}()
+
+	// skip objects larger than the configured max size
+	if svc.MaxSize > 0 && attrs.Size > svc.MaxSize {
+		status = "skip_oversize"
+		svc.countObject("success", status, s)
+		// logged at info so no object disappears silently
+		level.Info(l).Log("msg", "image", "section", s, "name", attrs.Name, "size", attrs.Size, "max_size", svc.MaxSize, "status", status)
+		return
+	}
+
+	// a missing crc32c would match every other object without one
+	listedCRC := attrs.CRC32C
+	if ok, err := svc.fillMissingCRC(ctx, src, attrs); err != nil {
+		failure = fmt.Errorf("%w: %w", ErrHash, err)
+		level.Error(errLog).Log("msg", "failed to compute missing crc32c", "name", attrs.Name, "error", failure)
+		svc.countObject("error", "hash", s)
+		return
+	} else if !ok {
+		status = "skip_no_checksum"
+		svc.countObject("success", status, s)
+		return
+	}
+	// the batch check looked the listed crc32c up, not the computed one
+	if attrs.CRC32C != listedCRC {
+		unstored = false
+	}
+
+	// destination bucket and object name
+	dst, dstName, err := svc.routeObject(dst, attrs)
+	if err != nil {
+		failure = fmt.Errorf("%w: %w", ErrCopy, err)
+		level.Error(errLog).Log("msg", "failed to rewrite destination name", "name", attrs.Name, "error", failure)
+		svc.countObject("error", "copy", s)
+		return
+	}
+
+	// fast path for re-runs, objects already in dst are never copied again
+	// and only their missing row is inserted
+	if svc.SkipExisting {
+		action, err := svc.existingState(ctx, dst, dstName, attrs.Name)
+		if err != nil {
+			failure = err
+			level.Error(errLog).Log("msg", "failed to check existing image", "name", attrs.Name, "dst", dstName, "error", failure)
+			svc.countObject("error", "skip_exists", s)
+			return
+		}
+		switch action {
+		case existingSkip:
+			status = "skip_exists"
+			svc.countObject("success", status, s)
+			level.Debug(l).Log("msg", "image", "section", s, "name", attrs.Name, "dst", dstName, "status", status)
+			return
+		case existingRepair:
+			status = "repair"
+			if err := svc.repairRow(ctx, src, attrs, s); err != nil {
+				failure = err
+				level.Error(errLog).Log("msg", "failed to repair image row", "name", attrs.Name, "dst", dstName, "error", failure)
+				svc.countObject("error", status, s)
+				return
+			}
+			// rows missing next to their copy are left by earlier bugs or manual
+			// copies, warn so their scale shows
+			svc.metrics.dbRepairs.Inc()
+			svc.countObject("success", status, s)
+			level.Warn(l).Log("msg", "image", "section", s, "name", attrs.Name, "dst", dstName, "status", status, "reason", "in dst without a row")
+			return
+		}
+	}
+
+	// reject corrupt images before any db work
+	if svc.ValidateImgs {
+		corrupt, err := svc.validateImage(ctx, src.Object(attrs.Name), attrs.Name)
+		if err != nil {
+			failure = fmt.Errorf("%w: %w", ErrValidate, err)
+			level.Error(errLog).Log("msg", "failed to read image for validation", "name", attrs.Name, "error", failure)
+			svc.countObject("error", "validate", s)
+			return
+		}
+		if corrupt != nil {
+			status = "skip_corrupt"
+			svc.countObject("success", status, s)
+			level.Warn(l).Log("msg", "image", "section", s, "name", attrs.Name, "status", status, "reason", corrupt)
+			if svc.RecordCorrupt {
+				if err := insertFailedImage(ctx, roach, attrs.Name, corrupt.Error()); err != nil {
+					level.Error(errLog).Log("msg", "failed to record corrupt image", "name", attrs.Name, "error", err)
+				}
+			}
+			return
+		}
+	}
+
+	// dedup key
+	key, err := svc.Hasher.Key(ctx, attrs, src.Object(attrs.Name))
+	if err != nil {
+		failure = fmt.Errorf("%w: %w", ErrHash, err)
+		level.Error(errLog).Log("msg", "failed to compute dedup key", "name", attrs.Name, "strategy", svc.HashStrategy, "error", failure)
+		svc.countObject("error", "hash", s)
+		return
+	}
+
+	// EXIF fields of the row, read before the insert so a failed read leaves
+	// the object to the next run
+	var meta *exifData
+	if svc.ExtractExif {
+		meta, err = svc.extractExif(ctx, src.Object(attrs.Name), attrs.Name)
+		if err != nil {
+			failure = fmt.Errorf("%w: %w", ErrExif, err)
+			level.Error(errLog).Log("msg", "failed to read exif", "name", attrs.Name, "error", failure)
+			svc.countObject("error", "exif", s)
+			return
+		}
+	}
+
+	// claim the key for this run, a later object with the same key may
+	// get here before this one's row is committed
+	match := svc.dedupMatch(attrs, s, key)
+	first := svc.seen.claim(match.key)
+
+	// check if image exists in database, unless the batch check found no
+	// stored crc32 to match
+	var found bool
+	if unstored {
+		svc.metrics.lookupsSkipped.Inc()
+	} else {
+		original, found, err = getDuplicate(ctx, roach, match, attrs.Name)
+	}
+	if err != nil {
+		if first {
+			svc.seen.release(match.key)
+		}
+		if svc.dbOutage(ctx, err) {
+			return err
+		}
+		failure = fmt.Errorf("%w: %w", ErrCount, err)
+		level.Error(errLog).Log("msg", "failed to look up existing image", "name", attrs.Name, "error", failure)
+		svc.countObject("error", "count", s)
+		return
+	} else if found {
+		count = 1
+		level.Debug(l).Log("msg", "duplicate", "section", s, "name", attrs.Name, "original", original, "crc32", attrs.CRC32C, "key", key)
+	}
+
+	// duplicate of an object already seen during this run
+	if count == 0 && !first {
+		level.Debug(l).Log("msg", "duplicate within run", "section", s, "name", attrs.Name, "key", key)
+		count = 1
+	}
+
+	// reserve a copy before inserting so an object refused by the copy limit
+	// is left untouched for the next run
+	if count == 0 && !svc.reserveCopy() {
+		svc.seen.release(match.key)
+		status = "skip_copy_limit"
+		svc.countObject("success", status, s)
+		level.Debug(l).Log("msg", "image", "section", s, "name", attrs.Name, "status", status)
+		return
+	}
+
+	insert := func() error {
+		err := insertImage(ctx, roach, attrs, s, svc.HashStrategy, key, svc.RunID)
+		if err == nil && meta != nil {
+			err = updateExif(ctx, roach, attrs.Name, meta)
+		}
+		return err
+	}
+
+	// with -copy-workers the row is inserted before the copy is handed to the
+	// copy stage, which marks the row copied and finishes the object
+	if count == 0 && svc.stage != nil {
+		if err := insert(); err != nil {
+			svc.releaseCopy()
+			svc.seen.release(match.key)
+			if svc.dbOutage(ctx, err) {
+				return err
+			}
+			failure = fmt.Errorf("%w: %w", ErrInsert, err)
+			svc.countObject("error", "insert", s)
+			level.Error(errLog).Log("msg", "failed to insert image", "name", attrs.Name, "error", failure)
+			return
+		}
+		level.Debug(l).Log("msg", "insert", "section", s, "name", attrs.Name, "count", count, "crc32", attrs.CRC32C)
+		handedOff = true
+		// the checkpoint waits for the copy, settled by stageCopy
+		svc.progress.hold(attrs.Name)
+		svc.stage.submit(&copyJob{
+			ctx:     ctx,
+			cancel:  cancel,
+			span:    span,
+			src:     src,
+			dst:     dst,
+			attrs:   attrs,
+			dstName: dstName,
+			section: s,
+		})
+		return
+	}
+
+	// database insert, overlapped with the copy of a new image
+	inserted := make(chan error, 1)
+	go func() {
+		inserted <- insert()
+	}()
+
+	// objects
+	var copyErr error
+	if count == 0 {
+		level.Debug(l).Log("msg", "init copy", "section", s, "name", attrs.Name, "dst", dstName, "count", count, "crc32", attrs.CRC32C)
+		status, copyErr = svc.copyImage(ctx, src, dst, dstName, attrs)
+		if copyErr != nil || status != "copy" {
+			svc.releaseCopy()
+		}
+	}
+
+	// join the insert, either failing fails the object. Without a copy made
+	// the object is left whole for a retry after a database outage.
+	if err := <-inserted; err != nil && copyErr == nil && status != "copy" && svc.dbOutage(ctx, err) {
+		if first {
+			svc.seen.release(match.key)
+		}
+		return err
+	} else if err != nil {
+		failure = fmt.Errorf("%w: %w", ErrInsert, err)
+		svc.countObject("error", "insert", s)
+		level.Error(errLog).Log("msg", "failed to insert image", "name", attrs.Name, "error", failure)
+		if first && status != "copy" {
+			svc.seen.release(match.key)
+		}
+	} else {
+		level.Debug(l).Log("msg", "insert", "section", s, "name", attrs.Name, "count", count, "crc32", attrs.CRC32C)
+	}
+	if copyErr != nil {
+		// with the row stored, retrying the copy alone completes the object.
+		// A mismatch isn't retried, a retry would find the corrupt copy in
+		// place, or the row dropped with it by -delete-crc-mismatch.
+		retry := failure == nil && !errors.Is(copyErr, ErrDelete) && !errors.Is(copyErr, ErrCRCMismatch)
+		failure = errors.Join(failure, copyErr)
+		svc.countObject("error", "copy", s)
+		level.Error(errLog).Log("msg", "copy", "section", s, "name", attrs.Name, "dst", dstName, "crc32", attrs.CRC32C, "error", copyErr)
+		if retry {
+			svc.retryLater(ctx, &copyRetry{src: src, dst: dst, attrs: attrs, dstName: dstName, section: s}, copyErr)
+		}
+	}
+	if failure != nil {
+		return
+	}
+
+	// the row only counts as an original once dst holds the image, a skipped
+	// copy found it there already with the source's crc32c
+	if count == 0 {
+		if err := markCopied(ctx, roach, attrs.Name, svc.staging()); err != nil {
+			failure = fmt.Errorf("%w: %w", ErrInsert, err)
+			svc.countObject("error", "insert", s)
+			level.Error(errLog).Log("msg", "failed to mark image copied", "name", attrs.Name, "error", failure)
+			return
+		}
+	}
+
+	switch {
+	case status == "copy":
+		level.Debug(l).Log("msg", "copy", "section", s, "name", attrs.Name, "count", count, "crc32", attrs.CRC32C)
+	case count > 0 && svc.TagDupes:
+		status = "tag"
+		if err := svc.tagDuplicate(ctx, src.Object(attrs.Name), attrs, original); err != nil {
+			failure = fmt.Errorf("%w: %w", ErrTag, err)
+			level.Error(errLog).Log("msg", "failed to tag duplicate", "section", s, "name", attrs.Name, "error", failure)
+			svc.countObject("error", status, s)
+			return
+		}
+	}
+
+	svc.countObject("success", status, s)
+	level.Info(l).Log("msg", "image", "section", s, "name", attrs.Name, "count", count, "original", original, "crc32", attrs.CRC32C, "status", status)
+	return nil
+}
+
+// finishObject records the outcome of a processed object: metrics, run stats,
+// its event and its span.
+func (svc *ImgDeduper) finishObject(ctx context.Context, span trace.Span, attrs *storage.ObjectAttrs, status, original string, failure error) {
+	if failure != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		svc.metrics.objectTimeouts.Inc()
+		failure = fmt.Errorf("%w: %w", ErrTimeout, failure)
+	}
+	failed := failure != nil
+	if failed {
+		svc.metrics.objectErrors.With(prometheus.Labels{"class": errorClass(failure)}).Inc()
+		span.RecordError(failure)
+	}
+	svc.stats.observe(objectSection(attrs.Name), status, failed, attrs.Size)
+	ev := ObjectEvent{Name: attrs.Name, Status: status, CRC32: attrs.CRC32C, Size: attrs.Size, Original: original}
+	if failed {
+		ev.Status = "error"
+	}
+	svc.emit(ev)
+	span.SetAttributes(attribute.String("status", status), attribute.Bool("failed", failed))
+	span.End()
+}
+
+// excluded returns the first -exclude pattern matching name.
+func (svc *ImgDeduper) excluded(name string) (string, bool) {
+	for _, pattern := range svc.Exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/go-kit/log/level"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"google.golang.org/api/iterator"
+)
+
+// promoteCounts tallies the outcome of a promote pass.
+type promoteCounts struct {
+	promoted atomic.Int64
+	present  atomic.Int64
+	missing  atomic.Int64
+	mismatch atomic.Int64
+	errored  atomic.Int64
+}
+
+// staging reports whether copies are stored under -staging-prefix.
+func (svc *ImgDeduper) staging() bool {
+	return svc.StagingPrefix != ""
+}
+
+// stagedName returns the staged name of the final dst name.
+func (svc *ImgDeduper) stagedName(name string) string {
+	if !svc.staging() {
+		return name
+	}
+	return strings.Trim(svc.StagingPrefix, "/") + "/" + name
+}
+
+// validateStaging checks -staging-prefix, which promote requires.
+func (svc *ImgDeduper) validateStaging() error {
+	if svc.Mode == modePromote && !svc.staging() {
+		return errors.New("promote requires the -staging-prefix copies were staged under")
+	}
+	if !svc.staging() {
+		return nil
+	}
+	p := strings.Trim(svc.StagingPrefix, "/")
+	if p == "" {
+		return fmt.Errorf("staging prefix %q is empty", svc.StagingPrefix)
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." || seg == "" {
+			return fmt.Errorf("staging prefix %q has an empty or '..' segment", svc.StagingPrefix)
+		}
+	}
+	return nil
+}
+
+// getStagedImages returns the names and crc32 of bucket's rows whose copy is
+// staged and not yet promoted. Rows stored without a bucket are included.
+func getStagedImages(ctx context.Context, roach *pgxpool.Pool, bucket string) ([]*storage.ObjectAttrs, error) {
+	ctx, span := tracer.Start(ctx, "db.staged")
+	defer span.End()
+
+	var images []*storage.ObjectAttrs
+	err := retryConn(ctx, "staged", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			images = images[:0]
+			rows, err := tx.Query(ctx, `SELECT name, crc32 FROM images
+				WHERE staged_at IS NOT NULL AND promoted_at IS NULL AND (bucket IS NULL OR bucket = $1)
+				ORDER BY name`, bucket)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var name string
+				var crc int64
+				if err := rows.Scan(&name, &crc); err != nil {
+					return err
+				}
+				images = append(images, &storage.ObjectAttrs{Name: name, CRC32C: uint32(crc)})
+			}
+			return rows.Err()
+		})
+	})
+	return images, err
+}
+
+// markPromoted records that the staged copy of the image name was moved to
+// its final name.
+func markPromoted(ctx context.Context, roach *pgxpool.Pool, name string) error {
+	ctx, span := tracer.Start(ctx, "db.promoted")
+	defer span.End()
+
+	return retryConn(ctx, "promoted", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "UPDATE images SET promoted_at = now() WHERE name = $1 AND promoted_at IS NULL", name)
+			return err
+		})
+	})
+}
+
+// stagedSource yields the staged rows, their name and stored crc32.
+type stagedSource struct {
+	images []*storage.ObjectAttrs
+}
+
+func (s *stagedSource) Next() (*storage.ObjectAttrs, error) {
+	if len(s.images) == 0 {
+		return nil, iterator.Done
+	}
+	attrs := s.images[0]
+	s.images = s.images[1:]
+	return attrs, nil
+}
+
+// promote moves the staged copies to their final dst names and marks their
+// rows promoted. Until then the final names are untouched, so deleting the
+// staging prefix and running again rolls a migration back. A promote stopped
+// midway picks up where it left off when run again.
+func (svc *ImgDeduper) promote(src, dst *storage.BucketHandle) error {
+	l := loggerFromContext(svc.Context)
+
+	images, err := getStagedImages(svc.Context, svc.Roach, svc.SrcBucketName)
+	if err != nil {
+		return err
+	}
+	level.Info(l).Log("msg", "promote started", "staged", len(images), "prefix", svc.StagingPrefix, "verify", svc.PromoteVerify, "workers", svc.Workers, "limit", svc.Limit)
+
+	var c promoteCounts
+	err = svc.forEachObject(&stagedSource{images: images}, func(ctx context.Context, row *storage.ObjectAttrs) {
+		svc.promoteImage(ctx, src, dst, row, &c)
+	})
+
+	level.Info(l).Log("msg", "promote summary",
+		"promoted", c.promoted.Load(),
+		"present", c.present.Load(),
+		"missing", c.missing.Load(),
+		"mismatch", c.mismatch.Load(),
+		"error", c.errored.Load())
+
+	if err != nil {
+		return err
+	}
+	if n := c.missing.Load() + c.mismatch.Load() + c.errored.Load(); n > 0 {
+		return fmt.Errorf("promote failed for %d images", n)
+	}
+	return nil
+}
+
+func (svc *ImgDeduper) promoteImage(ctx context.Context, src, dst *storage.BucketHandle, row *storage.ObjectAttrs, c *promoteCounts) {
+	l := loggerFromContext(svc.Context)
+	s := objectSection(row.Name)
+	fail := func(msg string, err error) {
+		level.Error(svc.errLog).Log("msg", msg, "name", row.Name, "error", err)
+		svc.countObject("error", "promote", s)
+		c.errored.Add(1)
+	}
+
+	// content type routes and dated names need the src attrs to pick the dst
+	attrs := row
+	if svc.dstNeedsAttrs() {
+		var err error
+		if attrs, err = svc.srcAttrs(ctx, src, row.Name); err != nil {
+			fail("failed to get src object attrs", err)
+			return
+		}
+	}
+	route, dstName, err := svc.finalObject(dst, attrs)
+	if err != nil {
+		fail("failed to rewrite destination name", err)
+		return
+	}
+	stagedName := svc.stagedName(dstName)
+
+	// a promote stopped after the move only needs the mark
+	status := "move"
+	staged := route.Object(stagedName)
+	stagedAttrs, err := staged.Attrs(ctx)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		_, ferr := route.Object(dstName).Attrs(ctx)
+		if errors.Is(ferr, storage.ErrObjectNotExist) {
+			level.Error(svc.errLog).Log("msg", "staged copy not found", "name", row.Name, "staged", stagedName)
+			svc.countObject("error", "not_found", s)
+			c.missing.Add(1)
+			return
+		}
+		if ferr != nil {
+			fail("failed to get dst object attrs", ferr)
+			return
+		}
+		status = "present"
+	case err != nil:
+		fail("failed to get staged object attrs", err)
+		return
+	case svc.PromoteVerify && stagedAttrs.CRC32C != row.CRC32C:
+		level.Warn(l).Log("msg", "staged copy crc32c mismatch, left staged", "name", row.Name, "staged", stagedName, "crc32", row.CRC32C, "staged_crc32", stagedAttrs.CRC32C)
+		svc.countObject("error", "promote_mismatch", s)
+		c.mismatch.Add(1)
+		return
+	default:
+		if status, err = svc.moveStaged(ctx, route, staged, stagedAttrs, dstName); err != nil {
+			fail("failed to promote staged copy", err)
+			return
+		}
+	}
+
+	if err := markPromoted(ctx, svc.Roach, row.Name); err != nil {
+		fail("failed to mark image promoted", fmt.Errorf("%w: %w", ErrInsert, err))
+		return
+	}
+	if status == "move" {
+		c.promoted.Add(1)
+	} else {
+		c.present.Add(1)
+	}
+	svc.countObject("success", "promote_"+status, s)
+	level.Info(l).Log("msg", "image promoted", "section", s, "name", row.Name, "staged", stagedName, "dst", dstName, "status", status)
+}
+
+// moveStaged rewrites the staged object to dstName and deletes it. An object
+// already at dstName is never replaced, a promote stopped before the delete
+// finds its own copy there and only deletes the staged one. The status is
+// move, or present when dstName already held the copy.
+func (svc *ImgDeduper) moveStaged(ctx context.Context, route *storage.BucketHandle, staged *storage.ObjectHandle, stagedAttrs *storage.ObjectAttrs, dstName string) (string, error) {
+	ctx, span := tracer.Start(ctx, "gcs.promote")
+	defer span.End()
+
+	status := "move"
+	final := route.Object(dstName)
+	c := final.If(storage.Conditions{DoesNotExist: true}).CopierFrom(staged.Generation(stagedAttrs.Generation))
+	// the rewrite would otherwise fall back to the bucket's class and key
+	c.ObjectAttrs = storage.ObjectAttrs{
+		ContentType:        stagedAttrs.ContentType,
+		ContentEncoding:    stagedAttrs.ContentEncoding,
+		ContentLanguage:    stagedAttrs.ContentLanguage,
+		ContentDisposition: stagedAttrs.ContentDisposition,
+		CacheControl:       stagedAttrs.CacheControl,
+		StorageClass:       stagedAttrs.StorageClass,
+		Metadata:           stagedAttrs.Metadata,
+	}
+	c.DestinationKMSKeyName, _, _ = strings.Cut(stagedAttrs.KMSKeyName, "/cryptoKeyVersions/")
+	finalAttrs, err := c.Run(ctx)
+	if isPreconditionFailed(err) {
+		status = "present"
+		finalAttrs, err = final.Attrs(ctx)
+	}
+	if err != nil {
+		return status, err
+	}
+	if finalAttrs.CRC32C != stagedAttrs.CRC32C {
+		return status, fmt.Errorf("%s holds another object, crc32c %d staged %d", dstName, finalAttrs.CRC32C, stagedAttrs.CRC32C)
+	}
+
+	if err := staged.Generation(stagedAttrs.Generation).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return status, fmt.Errorf("%w: %w", ErrDelete, err)
+	}
+	return status, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	readinessTimeout = 5 * time.Second
+	readinessTTL     = 10 * time.Second
+)
+
+// CheckDependencies pings the database and reads the src and dst bucket
+// attrs, returning the first failure.
+func (svc *ImgDeduper) CheckDependencies(ctx context.Context) error {
+	// subcommands without a database or dst skip their check
+	if svc.Roach != nil {
+		var one int
+		if err := svc.Roach.QueryRow(ctx, "SELECT 1").Scan(&one); err != nil {
+			return fmt.Errorf("database: %w", err)
+		}
+	}
+	if _, err := svc.Client.Bucket(svc.SrcBucketName).Attrs(ctx); err != nil {
+		return fmt.Errorf("src bucket %s: %w", svc.SrcBucketName, err)
+	}
+	if svc.DstBucketName != "" {
+		if _, err := svc.DstClient.Bucket(svc.DstBucketName).Attrs(ctx); err != nil {
+			return fmt.Errorf("dst bucket %s: %w", svc.DstBucketName, err)
+		}
+	}
+	return nil
+}
+
+// readinessCache memoizes the dependency check so frequent probes don't
+// hammer the database and GCS.
+type readinessCache struct {
+	mu      sync.Mutex
+	svc     Service
+	checked time.Time
+	err     error
+}
+
+// check returns the cached result, refreshing it once it is older than readinessTTL.
+func (rc *readinessCache) check(ctx context.Context) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if time.Since(rc.checked) < readinessTTL {
+		return rc.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	rc.err = rc.svc.CheckDependencies(ctx)
+	rc.checked = time.Now()
+	return rc.err
+}
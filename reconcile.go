@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/go-kit/log/level"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"google.golang.org/api/iterator"
+)
+
+// reconcileCounts tallies the outcome of a reconcile pass.
+type reconcileCounts struct {
+	copied  atomic.Int64
+	present atomic.Int64
+	missing atomic.Int64
+	skipped atomic.Int64
+	errored atomic.Int64
+}
+
+// getOrphanedImages returns, for every dedup key of bucket without a copied
+// row, the first name stored under it. Those images are in the database but
+// their copy failed after the row was inserted. Rows stored without a bucket
+// are included.
+//
+// With legacy the keys whose rows are all stamped with the epoch are returned
+// instead. Those rows were stored before copied_at was tracked, by runs that
+// inserted the row before the copy, and are only assumed copied.
+func getOrphanedImages(ctx context.Context, roach *pgxpool.Pool, bucket string, legacy bool) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "db.orphaned")
+	defer span.End()
+
+	var names []string
+	err := retryConn(ctx, "orphaned", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			names = names[:0]
+			query := `SELECT DISTINCT ON (hash_strategy, hash) name FROM images i
+				WHERE copied_at IS NULL AND (bucket IS NULL OR bucket = $1)
+				AND NOT EXISTS (SELECT 1 FROM images c WHERE c.hash_strategy = i.hash_strategy AND c.hash = i.hash AND c.copied_at IS NOT NULL)
+				ORDER BY hash_strategy, hash, name`
+			if legacy {
+				query = `SELECT DISTINCT ON (hash_strategy, hash) name FROM images i
+				WHERE copied_at = '1970-01-01 00:00:00+00' AND (bucket IS NULL OR bucket = $1)
+				AND NOT EXISTS (SELECT 1 FROM images c WHERE c.hash_strategy = i.hash_strategy AND c.hash = i.hash AND c.copied_at > '1970-01-01 00:00:00+00')
+				ORDER BY hash_strategy, hash, name`
+			}
+			rows, err := tx.Query(ctx, query, bucket)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var name string
+				if err := rows.Scan(&name); err != nil {
+					return err
+				}
+				names = append(names, name)
+			}
+			return rows.Err()
+		})
+	})
+	return names, err
+}
+
+// orphanSource yields the orphaned image names, their attrs are looked up by
+// the workers.
+type orphanSource struct {
+	names []string
+}
+
+func (s *orphanSource) Next() (*storage.ObjectAttrs, error) {
+	if len(s.names) == 0 {
+		return nil, iterator.Done
+	}
+	attrs := &storage.ObjectAttrs{Name: s.names[0]}
+	s.names = s.names[1:]
+	return attrs, nil
+}
+
+// reconcile copies the images whose row was stored but whose copy never
+// was, and sets their copied_at. Images already in dst are only marked.
+// Repaired rows are no longer orphaned, so running it again only picks up
+// what is left. Rows stamped with the epoch count as copied and are only
+// checked with -reconcile-legacy, which checks them instead.
+func (svc *ImgDeduper) reconcile(src, dst *storage.BucketHandle) error {
+	l := loggerFromContext(svc.Context)
+
+	names, err := getOrphanedImages(svc.Context, svc.Roach, svc.SrcBucketName, svc.LegacyRows)
+	if err != nil {
+		return err
+	}
+	level.Info(l).Log("msg", "reconcile started", "orphaned", len(names), "legacy", svc.LegacyRows, "workers", svc.Workers, "limit", svc.Limit)
+
+	var c reconcileCounts
+	err = svc.forEachObject(&orphanSource{names: names}, func(ctx context.Context, attrs *storage.ObjectAttrs) {
+		svc.reconcileImage(ctx, src, dst, attrs.Name, &c)
+	})
+
+	level.Info(l).Log("msg", "reconcile summary",
+		"repaired", c.copied.Load()+c.present.Load(),
+		"copied", c.copied.Load(),
+		"present", c.present.Load(),
+		"missing", c.missing.Load(),
+		"skipped", c.skipped.Load(),
+		"error", c.errored.Load())
+
+	if err != nil {
+		return err
+	}
+	if n := c.errored.Load(); n > 0 {
+		return fmt.Errorf("reconcile failed for %d images", n)
+	}
+	return nil
+}
+
+func (svc *ImgDeduper) reconcileImage(ctx context.Context, src, dst *storage.BucketHandle, name string, c *reconcileCounts) {
+	l := loggerFromContext(svc.Context)
+	s := objectSection(name)
+
+	// lookup fetches the src attrs, counting a failed lookup
+	var attrs *storage.ObjectAttrs
+	lookup := func() bool {
+		var err error
+		attrs, err = svc.srcAttrs(ctx, src, name)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			level.Error(svc.errLog).Log("msg", "orphaned image not found in src", "name", name)
+			svc.countObject("error", "not_found", s)
+			c.missing.Add(1)
+			return false
+		}
+		if err != nil {
+			level.Error(svc.errLog).Log("msg", "failed to get src object attrs", "name", name, "error", err)
+			svc.countObject("error", "reconcile", s)
+			c.errored.Add(1)
+			return false
+		}
+		return true
+	}
+
+	// content type routes and dated names need the attrs to pick the dst
+	route := dst
+	dstName, err := svc.dstObjectName(&storage.ObjectAttrs{Name: name})
+	if svc.dstNeedsAttrs() {
+		if !lookup() {
+			return
+		}
+		route, dstName, err = svc.routeObject(dst, attrs)
+	}
+	if err != nil {
+		level.Error(svc.errLog).Log("msg", "failed to rewrite destination name", "name", name, "error", err)
+		svc.countObject("error", "reconcile", s)
+		c.errored.Add(1)
+		return
+	}
+
+	// a copy that landed without its row being marked only needs the mark
+	status := "present"
+	_, err = route.Object(dstName).Attrs(ctx)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		if attrs == nil && !lookup() {
+			return
+		}
+
+		if !svc.reserveCopy() {
+			svc.countObject("success", "skip_copy_limit", s)
+			c.skipped.Add(1)
+			return
+		}
+		status, err = svc.copyImage(ctx, src, route, dstName, attrs)
+		if err != nil || status != "copy" {
+			svc.releaseCopy()
+		}
+		if err != nil {
+			level.Error(svc.errLog).Log("msg", "copy", "name", name, "dst", dstName, "error", err)
+			svc.countObject("error", "copy", s)
+			c.errored.Add(1)
+			return
+		}
+	case err != nil:
+		level.Error(svc.errLog).Log("msg", "failed to get dst object attrs", "name", name, "dst", dstName, "error", err)
+		svc.countObject("error", "reconcile", s)
+		c.errored.Add(1)
+		return
+	}
+
+	if err := markCopied(ctx, svc.Roach, name, svc.staging()); err != nil {
+		level.Error(svc.errLog).Log("msg", "failed to mark image copied", "name", name, "error", fmt.Errorf("%w: %w", ErrInsert, err))
+		svc.countObject("error", "insert", s)
+		c.errored.Add(1)
+		return
+	}
+	if status == "copy" {
+		c.copied.Add(1)
+	} else {
+		c.present.Add(1)
+	}
+	svc.countObject("success", "reconcile_"+status, s)
+	level.Info(l).Log("msg", "image reconciled", "section", s, "name", name, "dst", dstName, "status", status)
+}
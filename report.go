@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// report formats
+const (
+	reportCSV  = "csv"
+	reportJSON = "json"
+)
+
+// reportEntry is a single object of a dedup report.
+type reportEntry struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	CRC32     uint32 `json:"crc32"`
+	Key       string `json:"key"`
+	Duplicate bool   `json:"duplicate"`
+	// Original is the stored image this object duplicates and
+	// OriginalBucket the src bucket it was stored from.
+	Original       string `json:"original,omitempty"`
+	OriginalBucket string `json:"original_bucket,omitempty"`
+}
+
+// reportWriter writes report entries as CSV rows or JSONL, safe for
+// concurrent workers.
+type reportWriter struct {
+	mu     sync.Mutex
+	closer io.Closer
+	csv    *csv.Writer
+	json   *json.Encoder
+}
+
+// newReportWriter opens path, - for stdout, in the given format.
+func newReportWriter(path, format string) (*reportWriter, error) {
+	if format != reportCSV && format != reportJSON {
+		return nil, fmt.Errorf("unknown report format %q, expected %s or %s", format, reportCSV, reportJSON)
+	}
+
+	var w io.WriteCloser = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	r := &reportWriter{closer: w}
+	if format == reportJSON {
+		r.json = json.NewEncoder(w)
+		return r, nil
+	}
+	r.csv = csv.NewWriter(w)
+	if err := r.csv.Write([]string{"name", "size", "crc32", "key", "duplicate", "original", "original_bucket"}); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *reportWriter) write(e reportEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.json != nil {
+		return r.json.Encode(e)
+	}
+	return r.csv.Write([]string{
+		e.Name,
+		strconv.FormatInt(e.Size, 10),
+		strconv.FormatUint(uint64(e.CRC32), 10),
+		e.Key,
+		strconv.FormatBool(e.Duplicate),
+		e.Original,
+		e.OriginalBucket,
+	})
+}
+
+// Close flushes the report, stdout is left open.
+func (r *reportWriter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.csv != nil {
+		r.csv.Flush()
+		if err := r.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if r.closer == os.Stdout {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// report writes whether every listed src object is a duplicate of a stored
+// image, and which. With -dedupe-across-buckets only images stored from other
+// buckets count, reporting what a new bucket shares with earlier ones. It only
+// reads the database, main opens the pool read-only in this mode, and nothing
+// is copied.
+func (svc *ImgDeduper) report(b objectSource, src *storage.BucketHandle) error {
+	l := loggerFromContext(svc.Context)
+
+	if svc.ReportFile == "" {
+		return errors.New("report mode requires -report-file")
+	}
+	if svc.SamplePercent < 0 || svc.SamplePercent > 100 {
+		return fmt.Errorf("sample percent %d out of range 0-100", svc.SamplePercent)
+	}
+	w, err := newReportWriter(svc.ReportFile, svc.ReportFormat)
+	if err != nil {
+		return err
+	}
+
+	exclude := ""
+	if svc.AcrossBuckets {
+		exclude = svc.SrcBucketName
+	}
+
+	var duplicates, unique, errored, unsampled, noChecksum atomic.Int64
+	var sizeAll, sizeDup atomic.Int64
+	err = svc.forEachObject(b, func(ctx context.Context, attrs *storage.ObjectAttrs) {
+		if !svc.sampled(attrs.Name) {
+			unsampled.Add(1)
+			return
+		}
+		ok, err := svc.fillMissingCRC(ctx, src, attrs)
+		if !ok && err == nil {
+			noChecksum.Add(1)
+			return
+		}
+		key := ""
+		if err == nil {
+			key, err = svc.Hasher.Key(ctx, attrs, src.Object(attrs.Name))
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrHash, err)
+			level.Error(svc.errLog).Log("msg", "failed to compute dedup key", "name", attrs.Name, "strategy", svc.HashStrategy, "error", err)
+			svc.metrics.objectErrors.With(prometheus.Labels{"class": errorClass(err)}).Inc()
+			errored.Add(1)
+			return
+		}
+		match := svc.dedupMatch(attrs, objectSection(attrs.Name), key)
+		original, bucket, found, err := getOriginal(ctx, svc.Roach, match, exclude)
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrCount, err)
+			level.Error(svc.errLog).Log("msg", "failed to look up stored image", "name", attrs.Name, "error", err)
+			svc.metrics.objectErrors.With(prometheus.Labels{"class": errorClass(err)}).Inc()
+			errored.Add(1)
+			return
+		}
+
+		sizeAll.Add(attrs.Size)
+		if found {
+			duplicates.Add(1)
+			sizeDup.Add(attrs.Size)
+		} else {
+			unique.Add(1)
+		}
+		e := reportEntry{
+			Name:           attrs.Name,
+			Size:           attrs.Size,
+			CRC32:          attrs.CRC32C,
+			Key:            key,
+			Duplicate:      found,
+			Original:       original,
+			OriginalBucket: bucket,
+		}
+		if err := w.write(e); err != nil {
+			level.Error(svc.errLog).Log("msg", "failed to write report entry", "name", attrs.Name, "error", err)
+			errored.Add(1)
+		}
+	})
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+
+	level.Info(l).Log("msg", "report summary",
+		"duplicate", duplicates.Load(),
+		"unique", unique.Load(),
+		"unsampled", unsampled.Load(),
+		"no_checksum", noChecksum.Load(),
+		"error", errored.Load())
+	if svc.SamplePercent > 0 {
+		svc.logEstimate(duplicates.Load(), unique.Load(), sizeDup.Load(), sizeAll.Load())
+	}
+	return err
+}
+
+// sampled reports whether name is part of the -sample-percent sample. The
+// sample only depends on the name, so reruns report the same objects.
+func (svc *ImgDeduper) sampled(name string) bool {
+	if svc.SamplePercent <= 0 || svc.SamplePercent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32()%100) < svc.SamplePercent
+}
+
+// logEstimate extrapolates the duplicate ratio and the bytes a scan would
+// save from the sample. The margin is the 95% interval of the ratio assuming
+// a random sample, duplicates clustered under a few prefixes make it wider
+// than it looks.
+func (svc *ImgDeduper) logEstimate(duplicates, unique, sizeDup, sizeAll int64) {
+	l := loggerFromContext(svc.Context)
+	n := duplicates + unique
+	if n == 0 {
+		level.Warn(l).Log("msg", "no sampled objects, nothing to estimate", "sample_percent", svc.SamplePercent)
+		return
+	}
+
+	ratio := float64(duplicates) / float64(n)
+	margin := 1.96 * math.Sqrt(ratio*(1-ratio)/float64(n))
+	scale := 100 / float64(svc.SamplePercent)
+	level.Info(l).Log("msg", "dedup estimate",
+		"sample_percent", svc.SamplePercent,
+		"sampled", n,
+		"duplicate_ratio", fmt.Sprintf("%.4f", ratio),
+		"margin_95", fmt.Sprintf("%.4f", margin),
+		"objects", int64(float64(n)*scale),
+		"duplicates", int64(float64(duplicates)*scale),
+		"bytes", int64(float64(sizeAll)*scale),
+		"saved_bytes", int64(float64(sizeDup)*scale))
+	if n < 100 {
+		level.Warn(l).Log("msg", "small sample, the estimate is unreliable", "sampled", n)
+	}
+}
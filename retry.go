@@ -0,0 +1,247 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultCopyRetries = 3
+	defaultRetryDelay  = 5 * time.Second
+	maxRetryDelay      = 5 * time.Minute
+)
+
+// copyRetry is a failed copy waiting for another attempt. The object's row is
+// already stored, so only the copy is run again.
+type copyRetry struct {
+	src     *storage.BucketHandle
+	dst     *storage.BucketHandle
+	attrs   *storage.ObjectAttrs
+	dstName string
+	section string
+	attempt int
+	due     time.Time
+	// reqID is the request ID of the object the copy failed for
+	reqID string
+}
+
+// retryHeap orders retries by due time.
+type retryHeap []*copyRetry
+
+func (h retryHeap) Len() int           { return len(h) }
+func (h retryHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+func (h retryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *retryHeap) Push(x any)        { *h = append(*h, x.(*copyRetry)) }
+func (h *retryHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// retryQueue holds failed copies until their backoff expires. active counts
+// the queued and running retries, the run only ends once all are settled.
+type retryQueue struct {
+	mu      sync.Mutex
+	items   retryHeap
+	active  int
+	wake    chan struct{}
+	settled chan struct{}
+	length  prometheus.Gauge
+}
+
+func newRetryQueue(length prometheus.Gauge) *retryQueue {
+	return &retryQueue{
+		wake:    make(chan struct{}, 1),
+		settled: make(chan struct{}, 1),
+		length:  length,
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push queues r until r.due.
+func (q *retryQueue) push(r *copyRetry) {
+	q.mu.Lock()
+	heap.Push(&q.items, r)
+	q.active++
+	q.length.Set(float64(len(q.items)))
+	q.mu.Unlock()
+	notify(q.wake)
+}
+
+// due pops the retries due at now and returns how long until the next one,
+// zero when the queue is empty.
+func (q *retryQueue) due(now time.Time) ([]*copyRetry, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []*copyRetry
+	for len(q.items) > 0 && !q.items[0].due.After(now) {
+		due = append(due, heap.Pop(&q.items).(*copyRetry))
+	}
+	q.length.Set(float64(len(q.items)))
+	if len(q.items) == 0 {
+		return due, 0
+	}
+	return due, q.items[0].due.Sub(now)
+}
+
+// finish settles a dispatched retry.
+func (q *retryQueue) finish() {
+	q.mu.Lock()
+	q.active--
+	q.mu.Unlock()
+	notify(q.settled)
+}
+
+// drop discards the queued retries and returns them.
+func (q *retryQueue) drop() []*copyRetry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dropped := q.items
+	q.items = nil
+	q.active -= len(dropped)
+	q.length.Set(0)
+	return dropped
+}
+
+func (q *retryQueue) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active
+}
+
+// run hands retries to dispatch as they fall due until stop is closed.
+func (q *retryQueue) run(stop <-chan struct{}, dispatch func(*copyRetry)) {
+	for {
+		due, next := q.due(time.Now())
+		for _, r := range due {
+			dispatch(r)
+		}
+
+		// an empty queue waits for a push
+		if next == 0 {
+			next = maxRetryDelay
+		}
+		t := time.NewTimer(next)
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-q.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// waitRetries blocks until every retry is settled. Once the service is
+// stopped, queued retries are dropped rather than waited for.
+func (svc *ImgDeduper) waitRetries() {
+	l := loggerFromContext(svc.Context)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		if !svc.Ready.Load() {
+			for _, r := range svc.retries.drop() {
+				level.Warn(l).Log("msg", "service stopping, dropping copy retry", "name", r.attrs.Name, "attempt", r.attempt, "req_id", r.reqID)
+			}
+		}
+		if svc.retries.pending() == 0 {
+			return
+		}
+		select {
+		case <-svc.retries.settled:
+		case <-t.C:
+		}
+	}
+}
+
+// retryLater queues a failed copy for another attempt with an exponential
+// backoff, until -copy-retries attempts were made. The retry keeps the
+// request ID of ctx.
+func (svc *ImgDeduper) retryLater(ctx context.Context, r *copyRetry, err error) {
+	l := loggerFromContext(ctx)
+	if r.reqID == "" {
+		r.reqID = requestIDFromContext(ctx)
+	}
+	if r.attempt >= svc.CopyRetries || !svc.Ready.Load() {
+		if r.attempt > 0 {
+			level.Error(svc.errLogger(ctx)).Log("msg", "giving up on copy", "name", r.attrs.Name, "dst", r.dstName, "retries", r.attempt, "error", err)
+		}
+		return
+	}
+
+	delay := svc.RetryDelay << r.attempt
+	if delay < 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	r.attempt++
+	r.due = time.Now().Add(delay)
+	// the checkpoint waits for the retry, settled by retryCopy
+	svc.progress.hold(r.attrs.Name)
+	svc.retries.push(r)
+	level.Warn(l).Log("msg", "copy failed, retrying", "name", r.attrs.Name, "dst", r.dstName, "attempt", r.attempt, "delay", delay, "error", err)
+}
+
+// retryCopy runs a queued copy again. A retry it queues holds the
+// checkpoint in turn.
+func (svc *ImgDeduper) retryCopy(ctx context.Context, r *copyRetry) {
+	defer svc.progress.settle(r.attrs.Name)
+	if r.reqID != "" {
+		ctx = contextWithRequestID(ctx, r.reqID)
+	}
+	l := loggerFromContext(ctx)
+	attrs := r.attrs
+
+	if svc.ObjectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, svc.ObjectTimeout)
+		defer cancel()
+	}
+
+	if !svc.reserveCopy() {
+		level.Warn(l).Log("msg", "copy limit reached, dropping copy retry", "name", attrs.Name, "attempt", r.attempt)
+		return
+	}
+	status, err := svc.copyImage(ctx, r.src, r.dst, r.dstName, attrs)
+	if err != nil || status != "copy" {
+		svc.releaseCopy()
+	}
+	if err != nil {
+		svc.countObject("error", "copy", r.section)
+		svc.retryLater(ctx, r, err)
+		return
+	}
+	// only a copy this retry wrote is known good, a dst object found in
+	// place may be what an earlier attempt left, it is left to reconcile
+	if status != "copy" {
+		svc.countObject("success", status, r.section)
+		level.Warn(l).Log("msg", "copy retry found the dst object in place, not marking it copied", "name", attrs.Name, "dst", r.dstName, "attempt", r.attempt, "status", status)
+		return
+	}
+	if err := markCopied(ctx, svc.Roach, attrs.Name, svc.staging()); err != nil {
+		svc.countObject("error", "insert", r.section)
+		level.Error(svc.errLogger(ctx)).Log("msg", "failed to mark image copied", "name", attrs.Name, "error", fmt.Errorf("%w: %w", ErrInsert, err))
+		return
+	}
+
+	svc.countObject("success", status, r.section)
+	svc.emit(ObjectEvent{Name: attrs.Name, Status: status, CRC32: attrs.CRC32C, Size: attrs.Size})
+	level.Info(l).Log("msg", "image", "section", r.section, "name", attrs.Name, "crc32", attrs.CRC32C, "attempt", r.attempt, "status", status)
+}
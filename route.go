@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// dstRoute is where the objects of one content type are copied to.
+type dstRoute struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+// initRoutes parses the -route-content-type mappings of a media type to a
+// bucket[/prefix] destination.
+func (svc *ImgDeduper) initRoutes() error {
+	svc.routes = make(map[string]dstRoute, len(svc.ContentRoutes))
+	for contentType, target := range svc.ContentRoutes {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return fmt.Errorf("route content type %q: %w", contentType, err)
+		}
+		bucket, prefix, _ := strings.Cut(target, "/")
+		if bucket == "" {
+			return fmt.Errorf("route %s=%q, expected bucket[/prefix]", contentType, target)
+		}
+
+		b := svc.DstClient.Bucket(bucket)
+		if svc.DstProject != "" {
+			b = b.UserProject(svc.DstProject)
+		}
+		svc.routes[mediaType] = dstRoute{bucket: b, prefix: prefix}
+	}
+	return nil
+}
+
+// routeObject returns the dst bucket and object name of attrs, under
+// -staging-prefix when copies are staged. See finalObject.
+func (svc *ImgDeduper) routeObject(dst *storage.BucketHandle, attrs *storage.ObjectAttrs) (*storage.BucketHandle, string, error) {
+	b, name, err := svc.finalObject(dst, attrs)
+	if err != nil {
+		return b, "", err
+	}
+	return b, svc.stagedName(name), nil
+}
+
+// finalObject returns the dst bucket and final object name of attrs. An
+// object whose content type has a route goes to the route's bucket under its
+// prefix, which replaces -dst-prefix. Any other object goes to dst under
+// -dst-prefix. -dst-prefix-by-date and -dst-strip apply to every object.
+func (svc *ImgDeduper) finalObject(dst *storage.BucketHandle, attrs *storage.ObjectAttrs) (*storage.BucketHandle, string, error) {
+	b, prefix := dst, svc.DstPrefix
+	if len(svc.routes) > 0 {
+		// parameters such as charset don't take part in the match
+		if mediaType, _, err := mime.ParseMediaType(attrs.ContentType); err == nil {
+			if r, ok := svc.routes[mediaType]; ok {
+				b, prefix = r.bucket, r.prefix
+			}
+		}
+	}
+	prefix, err := svc.datedPrefix(prefix, attrs)
+	if err != nil {
+		return b, "", err
+	}
+	name, err := svc.rewriteName(attrs.Name, prefix)
+	return b, name, err
+}
+
+// dstObjectName rewrites a source object name into its destination name by
+// stripping DstStrip leading path segments and prepending DstPrefix and, with
+// DatePrefix, the object date, under StagingPrefix when copies are staged.
+func (svc *ImgDeduper) dstObjectName(attrs *storage.ObjectAttrs) (string, error) {
+	prefix, err := svc.datedPrefix(svc.DstPrefix, attrs)
+	if err != nil {
+		return "", err
+	}
+	n, err := svc.rewriteName(attrs.Name, prefix)
+	if err != nil {
+		return "", err
+	}
+	return svc.stagedName(n), nil
+}
+
+// rewriteName strips DstStrip leading path segments from name and prepends
+// prefix.
+func (svc *ImgDeduper) rewriteName(name, prefix string) (string, error) {
+	if svc.DstStrip == 0 && prefix == "" {
+		return name, nil
+	}
+
+	parts := strings.Split(name, "/")
+	if svc.DstStrip >= len(parts) {
+		return "", fmt.Errorf("cannot strip %d segments from %q", svc.DstStrip, name)
+	}
+	n := strings.Join(parts[svc.DstStrip:], "/")
+	if p := strings.Trim(prefix, "/"); p != "" {
+		n = p + "/" + n
+	}
+
+	if n == "" || strings.HasSuffix(n, "/") {
+		return "", fmt.Errorf("empty destination name for %q", name)
+	}
+	for _, seg := range strings.Split(n, "/") {
+		if seg == ".." {
+			return "", fmt.Errorf("destination name %q contains '..'", n)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/go-kit/log/level"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// run statuses recorded in the runs table
+const (
+	runRunning   = "running"
+	runCompleted = "completed"
+	runStopped   = "stopped"
+	runFailed    = "failed"
+)
+
+// runFinishTimeout bounds recording the end of a run, whose context may
+// already be cancelled.
+const runFinishTimeout = 10 * time.Second
+
+// insertRun records the start of a run with its configuration.
+func insertRun(ctx context.Context, roach *pgxpool.Pool, id string, config SvcOptions) error {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return retryConn(ctx, "insert_run", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx,
+				"INSERT INTO runs (id, started_at, status, config) VALUES ($1, now(), $2, $3)", id, runRunning, b)
+			return err
+		})
+	})
+}
+
+// updateRun records the end of a run with its final counters.
+func updateRun(ctx context.Context, roach *pgxpool.Pool, id, status string, stats StatsSnapshot) error {
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return retryConn(ctx, "update_run", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx,
+				"UPDATE runs SET ended_at = now(), status = $2, stats = $3 WHERE id = $1", id, status, b)
+			return err
+		})
+	})
+}
+
+// runStatus returns how the run ended: failed on err, stopped when the
+// service was stopped before the listing was exhausted, completed otherwise.
+func (svc *ImgDeduper) runStatus(err error) string {
+	switch {
+	case err != nil:
+		return runFailed
+	case !svc.Ready.Load():
+		return runStopped
+	}
+	return runCompleted
+}
+
+// finishRun records how the run ended, see runStatus.
+func (svc *ImgDeduper) finishRun(err error) {
+	l := loggerFromContext(svc.Context)
+
+	status := svc.runStatus(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), runFinishTimeout)
+	defer cancel()
+	if err := updateRun(ctx, svc.Roach, svc.RunID, status, svc.stats.Snapshot()); err != nil {
+		level.Error(l).Log("msg", "failed to record run end", "run_id", svc.RunID, "error", err)
+		return
+	}
+	level.Info(l).Log("msg", "run recorded", "run_id", svc.RunID, "status", status)
+}
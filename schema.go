@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/go-kit/log/level"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// initTable function performs a cockroachdb sql query using pgx. It uses crdbpgx for transaction handling (retries).
+func initTable(ctx context.Context, tx pgx.Tx) error {
+	l := loggerFromContext(ctx)
+
+	// Create the images table
+	// https://www.cockroachlabs.com/docs/stable/create-table#:~:text=Create%20a%20new%20table%20only,.%2C%20of%20the%20new%20table.
+	level.Info(l).Log("msg", "creating image table")
+	_, err := tx.Exec(ctx,
+		"CREATE TABLE IF NOT EXISTS images (name STRING PRIMARY KEY, section STRING, prefix STRING, size INT8, crc32 INT8)")
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			// fmt.Println(pgErr.Message) // => syntax error at end of input
+			// fmt.Println(pgErr.Code) // => 42601
+			if pgErr.Code != "42P07" {
+				return err
+			}
+		}
+
+	}
+
+	level.Info(l).Log("msg", "image table created")
+	return nil
+}
+
+// migrations are idempotent schema changes applied to existing images tables.
+var migrations = []string{
+	// generic dedup key, see Hasher
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS hash_strategy STRING",
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS hash STRING",
+	"UPDATE images SET hash_strategy = 'crc32', hash = crc32::INT8::STRING WHERE hash IS NULL",
+	// Content-Encoding of the stored bytes, see encodingHasher
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS content_encoding STRING",
+	// objects rejected by -validate-images, see -record-corrupt
+	"CREATE TABLE IF NOT EXISTS failed_images (name STRING PRIMARY KEY, reason STRING, failed_at TIMESTAMPTZ)",
+	// run audit, see runs.go
+	"CREATE TABLE IF NOT EXISTS runs (id UUID PRIMARY KEY, started_at TIMESTAMPTZ, ended_at TIMESTAMPTZ, status STRING, config JSONB, stats JSONB)",
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS run_id UUID",
+	// src bucket, names are only unique within a bucket
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS bucket STRING",
+	// set once the dst copy is stored, see markCopied. The default stamps
+	// rows stored before copies were tracked with the epoch, they are assumed
+	// copied. insertImage stores NULL explicitly.
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS copied_at TIMESTAMPTZ DEFAULT '1970-01-01 00:00:00+00'",
+	// EXIF fields, see -extract-exif. The capture time has no time zone.
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS exif_taken_at TIMESTAMP",
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS exif_model STRING",
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS exif_lat FLOAT8",
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS exif_lon FLOAT8",
+	// copies stored under -staging-prefix and their promotion, see promote.go
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS staged_at TIMESTAMPTZ",
+	"ALTER TABLE images ADD COLUMN IF NOT EXISTS promoted_at TIMESTAMPTZ",
+}
+
+// migrateTable function applies the schema migrations. It uses crdbpgx for transaction handling (retries).
+func migrateTable(ctx context.Context, tx pgx.Tx) error {
+	l := loggerFromContext(ctx)
+
+	for _, m := range migrations {
+		level.Debug(l).Log("msg", "migrating image table", "sql", m)
+		if _, err := tx.Exec(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	level.Info(l).Log("msg", "image table migrated")
+	return nil
+}
+
+// legacyColumnTypes are the column types of tables created before size and
+// crc32 were stored as integers.
+var legacyColumnTypes = map[string]string{
+	"size":  "double precision",
+	"crc32": "oid",
+}
+
+// legacyColumns returns the images columns that still have their legacy type.
+func legacyColumns(ctx context.Context, roach *pgxpool.Pool) ([]string, error) {
+	var cols []string
+	for col, legacy := range legacyColumnTypes {
+		var dataType string
+		err := roach.QueryRow(ctx,
+			"SELECT data_type FROM information_schema.columns WHERE table_name = 'images' AND column_name = $1", col).Scan(&dataType)
+		if err != nil {
+			return nil, err
+		}
+		if dataType == legacy {
+			cols = append(cols, col)
+		}
+	}
+	return cols, nil
+}
+
+// migrateColumnType converts a legacy column to INT8 by backfilling a new
+// column and swapping it in. CockroachDB runs schema changes in their own
+// transactions, so each statement is executed on its own.
+func migrateColumnType(ctx context.Context, roach *pgxpool.Pool, col string) error {
+	l := loggerFromContext(ctx)
+	tmp := col + "_int8"
+
+	level.Info(l).Log("msg", "migrating column type", "column", col, "type", "INT8")
+	stmts := []string{
+		fmt.Sprintf("ALTER TABLE images ADD COLUMN IF NOT EXISTS %s INT8", tmp),
+		fmt.Sprintf("UPDATE images SET %s = %s::INT8 WHERE %s IS NULL", tmp, col, tmp),
+		// indexes on the legacy column are recreated by initIndex
+		fmt.Sprintf("DROP INDEX IF EXISTS images_%s_idx", col),
+		fmt.Sprintf("ALTER TABLE images DROP COLUMN %s", col),
+		fmt.Sprintf("ALTER TABLE images RENAME COLUMN %s TO %s", tmp, col),
+	}
+	for _, stmt := range stmts {
+		if _, err := roach.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("migrate %s: %w", col, err)
+		}
+	}
+
+	level.Info(l).Log("msg", "column type migrated", "column", col, "type", "INT8")
+	return nil
+}
+
+// initIndex function creates the secondary indexes backing the dedup lookup. It uses crdbpgx for transaction handling (retries).
+func initIndex(ctx context.Context, tx pgx.Tx) error {
+	l := loggerFromContext(ctx)
+
+	level.Info(l).Log("msg", "creating dedup indexes")
+	if _, err := tx.Exec(ctx, "CREATE INDEX IF NOT EXISTS images_crc32_idx ON images (crc32)"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "CREATE INDEX IF NOT EXISTS images_hash_idx ON images (hash_strategy, hash)"); err != nil {
+		return err
+	}
+
+	level.Info(l).Log("msg", "dedup indexes created")
+	return nil
+}
+
+// hasIndex reports whether the images table has the named index.
+func hasIndex(ctx context.Context, roach *pgxpool.Pool, name string) (bool, error) {
+	exists := false
+	err := roach.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM pg_indexes WHERE tablename = 'images' AND indexname = $1)", name).Scan(&exists)
+	return exists, err
+}
+
+// migrate sets up the images table, its migrations and the dedup indexes.
+func (svc *ImgDeduper) migrate() error {
+	l := loggerFromContext(svc.Context)
+
+	// Set up table
+	err := crdbpgx.ExecuteTx(svc.Context, svc.Roach, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		return initTable(svc.Context, tx)
+	})
+	if err != nil {
+		return err
+	}
+	err = crdbpgx.ExecuteTx(svc.Context, svc.Roach, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		return migrateTable(svc.Context, tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Convert legacy column types
+	legacy, err := legacyColumns(svc.Context, svc.Roach)
+	if err != nil {
+		return err
+	}
+	for _, col := range legacy {
+		if !svc.MigrateTypes {
+			level.Warn(l).Log("msg", "images column has a legacy type, run with -migrate-column-types to convert it", "column", col, "type", legacyColumnTypes[col])
+			continue
+		}
+		if err := migrateColumnType(svc.Context, svc.Roach, col); err != nil {
+			return err
+		}
+	}
+
+	// Set up dedup indexes
+	if svc.CRCIndex {
+		err := crdbpgx.ExecuteTx(svc.Context, svc.Roach, pgx.TxOptions{}, func(tx pgx.Tx) error {
+			return initIndex(svc.Context, tx)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	indexed, err := hasIndex(svc.Context, svc.Roach, "images_hash_idx")
+	if err != nil {
+		return err
+	}
+	level.Info(l).Log("msg", "dedup index", "exists", indexed)
+	if !indexed {
+		level.Warn(l).Log("msg", "dedup index missing, dedup lookups will scan the images table")
+	}
+
+	return nil
+}
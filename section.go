@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// rootSection is the section of objects at the bucket root.
+const rootSection = "_root"
+
+// objectSection returns the section of an object, the first element of its
+// name. Leading slashes are ignored, so /a/b.jpg is in section a, and objects
+// without a directory are in rootSection, never in an empty one.
+func objectSection(name string) string {
+	name = strings.TrimLeft(name, "/")
+	section, _, ok := strings.Cut(name, "/")
+	if !ok {
+		return rootSection
+	}
+	return section
+}
+
+// sectionSem is a counting semaphore for one section. refs tracks holders
+// and waiters so the semaphore can be dropped once the section goes idle.
+type sectionSem struct {
+	slots chan struct{}
+	refs  int
+}
+
+// sectionLimiter caps the number of objects of a single section processed
+// concurrently. A zero max disables the cap.
+type sectionLimiter struct {
+	mu   sync.Mutex
+	max  int
+	sems map[string]*sectionSem
+}
+
+func newSectionLimiter(max int) *sectionLimiter {
+	return &sectionLimiter{
+		max:  max,
+		sems: make(map[string]*sectionSem),
+	}
+}
+
+// acquire blocks until the section has a free slot or ctx is done.
+func (sl *sectionLimiter) acquire(ctx context.Context, section string) error {
+	if sl.max <= 0 {
+		return nil
+	}
+
+	sl.mu.Lock()
+	sem, ok := sl.sems[section]
+	if !ok {
+		sem = &sectionSem{slots: make(chan struct{}, sl.max)}
+		sl.sems[section] = sem
+	}
+	sem.refs++
+	sl.mu.Unlock()
+
+	select {
+	case sem.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		sl.unref(section, sem)
+		return ctx.Err()
+	}
+}
+
+// release frees a slot acquired for section.
+func (sl *sectionLimiter) release(section string) {
+	if sl.max <= 0 {
+		return
+	}
+
+	sl.mu.Lock()
+	sem := sl.sems[section]
+	sl.mu.Unlock()
+
+	<-sem.slots
+	sl.unref(section, sem)
+}
+
+// unref drops a reference and removes the semaphore of an idle section.
+func (sl *sectionLimiter) unref(section string, sem *sectionSem) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sem.refs--
+	if sem.refs == 0 {
+		delete(sl.sems, section)
+	}
+}
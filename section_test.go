@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestObjectSection(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"foo.jpg", rootSection},
+		{"/foo.jpg", rootSection},
+		{"a/b/c.jpg", "a"},
+		{"/a/b.jpg", "a"},
+		{"//a/b.jpg", "a"},
+		{"a/b.jpg", "a"},
+	}
+	for _, tt := range tests {
+		if got := objectSection(tt.name); got != tt.want {
+			t.Errorf("objectSection(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "sync"
+
+// keySet remembers the dedup keys claimed during a run so that two objects
+// with the same content racing through the worker pool aren't both copied.
+// It stops recording new keys once max entries are held, after which
+// deduplication relies on the database alone.
+type keySet struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]struct{}
+}
+
+func newKeySet(max int) *keySet {
+	return &keySet{
+		max:  max,
+		seen: make(map[string]struct{}),
+	}
+}
+
+// claim records key and reports whether this is the first claim this run.
+func (c *keySet) claim(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	if len(c.seen) < c.max {
+		c.seen[key] = struct{}{}
+	}
+	return true
+}
+
+// release forgets a claim whose object failed before its row was inserted.
+func (c *keySet) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.seen, key)
+}
+
+// reset drops every claim.
+func (c *keySet) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen = make(map[string]struct{})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/storage"
+)
+
+// selfcheckColumns are the images columns the current code reads and writes.
+var selfcheckColumns = []string{"name", "section", "prefix", "size", "crc32", "hash_strategy", "hash", "content_encoding", "run_id", "bucket", "copied_at"}
+
+// selfcheck validates the configuration and the connectivity a scan needs
+// without processing any object, printing one line per check to stdout. An
+// error is returned when any check fails.
+func (svc *ImgDeduper) selfcheck(src, dst *storage.BucketHandle) error {
+	ctx := svc.Context
+	checks := []struct {
+		name string
+		run  func(context.Context) error
+	}{
+		{"options", func(context.Context) error {
+			if _, err := newHasher(svc.HashStrategy); err != nil {
+				return err
+			}
+			if err := validateStorageClass(svc.StorageClass); err != nil {
+				return err
+			}
+			if err := validateChunkSize(svc.ChunkSize); err != nil {
+				return err
+			}
+			if err := svc.validateSrcURL(); err != nil {
+				return err
+			}
+			return svc.validateKMSKey()
+		}},
+		{"database", func(ctx context.Context) error {
+			var one int
+			return svc.Roach.QueryRow(ctx, "SELECT 1").Scan(&one)
+		}},
+		{"schema", svc.checkSchema},
+		{"src bucket " + svc.SrcBucketName, func(ctx context.Context) error {
+			_, err := src.Attrs(ctx)
+			return err
+		}},
+		{"dst bucket " + svc.DstBucketName, func(ctx context.Context) error {
+			_, err := dst.Attrs(ctx)
+			if errors.Is(err, storage.ErrBucketNotExist) && svc.CreateDst {
+				return fmt.Errorf("%w, a scan with -create-dst creates it", err)
+			}
+			return err
+		}},
+		{"permissions", func(ctx context.Context) error {
+			return svc.preflight(ctx, src, dst)
+		}},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		result := "ok"
+		if err := c.run(ctx); err != nil {
+			result = "FAIL " + err.Error()
+			failed++
+		}
+		fmt.Fprintf(os.Stdout, "%-40s %s\n", c.name, result)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("selfcheck: %d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// checkSchema verifies the images table has every column in use and the
+// dedup index. A missing schema is created by scan or migrate.
+func (svc *ImgDeduper) checkSchema(ctx context.Context) error {
+	rows, err := svc.Roach.Query(ctx,
+		"SELECT column_name FROM information_schema.columns WHERE table_name = 'images'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	has := map[string]bool{}
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return err
+		}
+		has[col] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(has) == 0 {
+		return errors.New("images table missing, run migrate")
+	}
+	var missing []string
+	for _, col := range selfcheckColumns {
+		if !has[col] {
+			missing = append(missing, col)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("images columns %v missing, run migrate", missing)
+	}
+
+	if svc.CRCIndex {
+		indexed, err := hasIndex(ctx, svc.Roach, "images_hash_idx")
+		if err != nil {
+			return err
+		}
+		if !indexed {
+			return errors.New("dedup index missing, run migrate")
+		}
+	}
+	return nil
+}
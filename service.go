@@ -4,68 +4,228 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"path/filepath"
+	"path"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"cloud.google.com/go/storage"
-	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"google.golang.org/api/iterator"
 )
 
-var (
-	objectProcessed = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "meta",
-			Name:      "objects_processed",
-			Help:      "Total objects processed",
-		},
-		[]string{"status","operation"},
-	)
+const (
+	modeScan      = "scan"
+	modeVerify    = "verify"
+	modeReport    = "report"
+	modeMigrate   = "migrate"
+	modeSelfcheck = "selfcheck"
+	modeReconcile = "reconcile"
+	modeGC        = "gc"
+	modeList      = "list"
+	modePromote   = "promote"
+	modeNotify    = "setup-notifications"
+	modeTestConn  = "test-connection"
 )
 
 // SvcOptions are service specific process inputs such as arguments
 type SvcOptions struct {
+	Mode          string
+	Workers       int
+	QueueSize     int
+	MaxMemory     int64
 	Limit         int
+	CopyLimit     int
+	DrainTimeout  time.Duration
+	MaxRuntime    time.Duration
+	StartJitter   time.Duration
+	ObjectTimeout time.Duration
+	MaxSize       int64
+	MinSize       int64
+	UpdatedSince  time.Time
+	UpdatedUntil  time.Time
+	Sections      []string
 	Prefix        string
+	Glob          string
+	Exclude       []string
+	StartAfter    string
+	Checkpoint    string
+	CheckEvery    int
+	ShardIndex    int
+	ShardCount    int
+	NamesFile     string
+	SrcURL        string
 	SrcBucketName string
 	DstBucketName string
+	DstPrefix     string
+	DatePrefix    bool
+	DateField     string
+	StagingPrefix string
+	PromoteVerify bool
+	NotifyTopic   string
+	NotifyPrefix  string
+	BatchCheck    int
+	DstStrip      int
+	Manifest      string
+	BigQueryTable string
+	BigQueryBatch int
+	Transform     bool
+	JPEGQuality   int
+	ChunkSize     int
+	SectionLimit  int
+	SectionStats  int
+	SectionRatios bool
+	SeenLimit     int
+	CRCIndex      bool
+	MigrateTypes  bool
+	SummaryFile   string
+	ReportFile    string
+	ReportFormat  string
+	DupesOnly     bool
+	SamplePercent int
+	AcrossBuckets bool
+	GCCheck       string
+	ListDetails   bool
+	StorageClass  string
+	CreateDst     bool
+	CreateProject string
+	CreateRegion  string
+	CreateClass   string
+	TestTimeout   time.Duration
+	KMSKey        string
+	KeepMetadata  bool
+	Metadata      map[string]string
+	Provenance    bool
+	ContentRoutes map[string]string
+	SkipExisting  bool
+	ValidateImgs  bool
+	ExtractExif   bool
+	RecordCorrupt bool
+	Overwrite     bool
+	OverwriteNew  bool
+	TagDupes      bool
+	HashStrategy  string
+	MissingCRC    string
+	DedupKeys     []string
+	DstProject    string
+	Preflight     bool
+	LogSampling   time.Duration
+	MetricsNS     string
+	MetricsSub    string
+	Pushgateway   string
+	PushJob       string
+	WebhookURL    string
+	SectionLabels bool
+	SectionAllow  []string
+	DropMismatch  bool
+	CopyRetries   int
+	RetryDelay    time.Duration
+	PinConns      bool
+	CopyWorkers   int
+	BreakerLimit  int
+	BreakerPause  time.Duration
+	DrainOnDBErr  bool
+	LegacyRows    bool
+	GCNullBucket  bool
 }
 
 // Service is a standard and generic service interface
 type Service interface {
 	Start() error
-	Stop()
+	Stop() bool
 	IsReady() bool
+	Stats() StatsSnapshot
+	CheckDependencies(ctx context.Context) error
+	Subscribe() (<-chan ObjectEvent, func())
 }
 
 // ImgDeduper is a service that performs "chunking" of a large body of images.
 type ImgDeduper struct {
-	Context       context.Context
-	Ready         bool
-	Limit         int
-	Prefix        string
-	SrcBucketName string
-	DstBucketName string
-	Client        *storage.Client
-	Roach         *pgx.Conn
+	// the options the service was created with, flattened into its fields
+	SvcOptions
+
+	Context      context.Context
+	cancel       context.CancelFunc
+	done         chan struct{}
+	Ready        atomic.Bool
+	copies       atomic.Int64
+	gcs          *breaker
+	pause        *dbPause
+	retries      *retryQueue
+	stage        *copyStage
+	Hasher       Hasher
+	routes       map[string]dstRoute
+	sections     *sectionLimiter
+	predicate    copyPredicate
+	seen         *keySet
+	unstored     *unstoredSet
+	progress     *checkpointTracker
+	Client       *storage.Client
+	DstClient    *storage.Client
+	RunID        string
+	Roach        *pgxpool.Pool
+	errLog       log.Logger
+	sectionAllow map[string]bool
+	stats        *RunStats
+	events       *broadcaster
+	sinks        []EventSink
+	metrics      *metrics
+	config       SvcOptions
 }
 
 // NewSvc creates an instance of the ImageChunker service.
-func NewSvc(ctx context.Context, client *storage.Client, roach *pgx.Conn, o *SvcOptions) Service {
+// The dst client may be the same as the src client when a single identity is used.
+func NewSvc(ctx context.Context, client, dstClient *storage.Client, roach *pgxpool.Pool, o *SvcOptions) Service {
+	namespace := o.MetricsNS
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+	m := newMetrics(prometheus.DefaultRegisterer, namespace, o.MetricsSub)
+	ctx = contextWithMetrics(ctx, m)
+	ctx = contextWithBreaker(ctx, newBreaker("db", o.BreakerLimit, o.BreakerPause, isConnError, m))
+	if roach != nil {
+		registerPoolMetrics(prometheus.DefaultRegisterer, namespace, o.MetricsSub, roach)
+	}
+
+	// per-section duplicate ratios, bounded by the -section-stats cap
+	var ratios *prometheus.GaugeVec
+	if o.SectionRatios {
+		ratios = m.sectionRatio
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	allow := make(map[string]bool, len(o.SectionAllow))
+	for _, section := range o.SectionAllow {
+		allow[section] = true
+	}
+	events := newBroadcaster()
 	return &ImgDeduper{
-		Context:       ctx,
-		Ready:         false,
-		Limit:         o.Limit,
-		Prefix:        o.Prefix,
-		SrcBucketName: o.SrcBucketName,
-		DstBucketName: o.DstBucketName,
-		Client:        client,
-		Roach:         roach,
+		SvcOptions: *o,
+
+		Context:      ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+		gcs:          newBreaker("gcs", o.BreakerLimit, o.BreakerPause, isGCSOutage, m),
+		pause:        newDBPause(o.DrainOnDBErr && roach != nil, roach.Ping, m),
+		retries:      newRetryQueue(m.copyRetryQueue),
+		sections:     newSectionLimiter(o.SectionLimit),
+		predicate:    newCopyPredicate(o),
+		seen:         newKeySet(o.SeenLimit),
+		unstored:     &unstoredSet{},
+		Client:       client,
+		DstClient:    dstClient,
+		Roach:        roach,
+		RunID:        uuid.NewString(),
+		sectionAllow: allow,
+		errLog:       newSamplingLogger(loggerFromContext(ctx), o.LogSampling),
+		stats:        newRunStats(newSectionStats(o.SectionStats, ratios)),
+		events:       events,
+		sinks:        []EventSink{events},
+		metrics:      m,
+		config:       o.redacted(),
 	}
 }
 
@@ -75,197 +235,366 @@ func NewSvc(ctx context.Context, client *storage.Client, roach *pgx.Conn, o *Svc
 //	True when the service is processing SQS messages
 //	Otherwise False
 func (svc *ImgDeduper) IsReady() bool {
-	return svc.Ready
+	return svc.Ready.Load()
 }
 
-// initTable function performs a cockroachdb sql query using pgx. It uses crdbpgx for transaction handling (retries).
-func initTable(ctx context.Context, tx pgx.Tx) error {
-	l := loggerFromContext(ctx)
-
-	// Create the images table
-	// https://www.cockroachlabs.com/docs/stable/create-table#:~:text=Create%20a%20new%20table%20only,.%2C%20of%20the%20new%20table.
-	level.Info(l).Log("msg", "creating image table")
-	_, err := tx.Exec(ctx,
-		"CREATE TABLE IF NOT EXISTS images (name STRING PRIMARY KEY, section STRING, prefix STRING, size FLOAT, crc32 OID)")
-	if err != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) {
-			// fmt.Println(pgErr.Message) // => syntax error at end of input
-			// fmt.Println(pgErr.Code) // => 42601
-			if pgErr.Code != "42P07" {
-				return err
-			}
-		}
-
+// Stats returns the counters of the current run.
+func (svc *ImgDeduper) Stats() StatsSnapshot {
+	s := svc.stats.Snapshot()
+	if since := svc.pause.paused(); !since.IsZero() {
+		s.DBPaused = true
+		s.PausedFor = time.Since(since).Seconds()
 	}
+	return s
+}
 
-	level.Info(l).Log("msg", "image table created")
-	return nil
+// Subscribe returns a stream of processed object events and a func to
+// unsubscribe from it. The stream is closed if the subscriber falls behind.
+func (svc *ImgDeduper) Subscribe() (<-chan ObjectEvent, func()) {
+	return svc.events.subscribe()
 }
 
-func insertImage(ctx context.Context, roach *pgx.Conn, i *storage.ObjectAttrs, s string) error {
-	err := crdbpgx.ExecuteTx(ctx, roach, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		inner := func() error {
-			_, err := tx.Exec(ctx,
-				"INSERT INTO images (name, section, prefix, size, crc32) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (name) DO NOTHING", i.Name, s, filepath.Dir(i.Name), i.Size, i.CRC32C)
-			if err != nil {
-				return err
-			}
-			return nil
-		}
+// Start begins the ImgDeduper service loop
+func (svc *ImgDeduper) Start() (err error) {
+	defer close(svc.done)
+	defer svc.pushMetrics()
+	defer func() { svc.notifyWebhook(err) }()
 
-		return inner()
-	})
-	if err != nil {
-	 return err
+	// logger
+	l := loggerFromContext(svc.Context)
+	level.Info(l).Log("msg", "service started")
+
+	if svc.Mode == modeMigrate {
+		return svc.migrate()
 	}
 
-	return nil
-}
+	// bucket handler
+	dst := svc.DstClient.Bucket(svc.DstBucketName)
+	if svc.DstProject != "" {
+		dst = dst.UserProject(svc.DstProject)
+	}
+	src := svc.Client.Bucket(svc.SrcBucketName)
+	level.Info(l).Log("msg", "dst bucket", "name", svc.DstBucketName)
+	level.Info(l).Log("msg", "src bucket", "name", svc.SrcBucketName)
 
-// getImageCount function performs a cockroachdb sql query using pgx. It uses crdbpgx for transaction handling (retries).
-// The inner function allows to return the count value from the query.
-func getImageCount(ctx context.Context, roach *pgx.Conn, crc32 uint32) (int, error) {
-	// init count
-	count := 0
-
-	// check if image exists in database
-	err := crdbpgx.ExecuteTx(ctx, roach, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		inner := func() error {
-			// inner function
-			rows, err := tx.Query(ctx, "SELECT COUNT(*) FROM images WHERE crc32 = $1", crc32)
-			if err != nil {
-				return err
-			}
+	if svc.Mode == modeSelfcheck {
+		return svc.selfcheck(src, dst)
+	}
+	if svc.Mode == modeNotify {
+		return svc.setupNotifications(src)
+	}
 
-			for rows.Next() {
-				if err := rows.Scan(&count); err != nil {
-					return err
-				}
-			}
+	q, err := listingQuery(svc.Prefix, svc.Glob)
+	if err != nil {
+		return err
+	}
+	fields := svc.listAttrs()
+	if err := q.SetAttrSelection(fields); err != nil {
+		return err
+	}
+	level.Info(l).Log("msg", "listing query", "glob", q.MatchGlob, "attrs", strings.Join(fields, ","))
 
-			return nil
+	if err := validateStorageClass(svc.StorageClass); err != nil {
+		return err
+	}
+	if err := validateStorageClass(svc.CreateClass); err != nil {
+		return err
+	}
+	if err := validateChunkSize(svc.ChunkSize); err != nil {
+		return err
+	}
+	if err := svc.validateSrcURL(); err != nil {
+		return err
+	}
+	if err := svc.validateKMSKey(); err != nil {
+		return err
+	}
+	if err := svc.initRoutes(); err != nil {
+		return err
+	}
+	if err := validateDedupKeys(svc.DedupKeys); err != nil {
+		return err
+	}
+	if err := svc.validateStaging(); err != nil {
+		return err
+	}
+	if err := svc.validateShard(); err != nil {
+		return err
+	}
+	if err := svc.validateBatchCheck(); err != nil {
+		return err
+	}
+	if err := svc.validateBreaker(); err != nil {
+		return err
+	}
+	if err := svc.validateDatePrefix(); err != nil {
+		return err
+	}
+	if err := validateMissingCRC(svc.MissingCRC); err != nil {
+		return err
+	}
+	for _, pattern := range svc.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("exclude %q: %w", pattern, err)
 		}
-
-		return inner()
-	})
-	if err != nil {
-		return count, err
 	}
 
-	return count, nil
-}
+	// resume a scan handed over through -checkpoint-file, -start-after wins
+	if svc.Checkpoint != "" {
+		if svc.NamesFile != "" {
+			return errors.New("checkpoint file follows the listing order, it can't be combined with a names file")
+		}
+		if svc.StartAfter == "" {
+			svc.StartAfter = svc.readCheckpoint(svc.Checkpoint, q.MatchGlob)
+		}
+		svc.progress = newCheckpointTracker(svc.Checkpoint, svc.CheckEvery, checkpointState{
+			StartAfter: svc.StartAfter,
+			Glob:       q.MatchGlob,
+			ShardIndex: svc.ShardIndex,
+			ShardCount: svc.ShardCount,
+		}, l)
+	}
 
-// Start begins the ImgDeduper service loop
-func (svc *ImgDeduper) Start() error {
-	// logger
-	l := loggerFromContext(svc.Context)
-	level.Info(l).Log("msg", "service started")
+	// resume listing after a known object name
+	if svc.StartAfter != "" {
+		lit := q.MatchGlob
+		if i := strings.IndexAny(lit, "*?[{"); i >= 0 {
+			lit = lit[:i]
+		}
+		if !strings.HasPrefix(svc.StartAfter, lit) {
+			return fmt.Errorf("start-after %q is outside glob %q", svc.StartAfter, q.MatchGlob)
+		}
+		// StartOffset is inclusive, the NUL suffix makes it start strictly after the name
+		q.StartOffset = svc.StartAfter + "\x00"
+		level.Info(l).Log("msg", "listing starts after", "name", svc.StartAfter)
+	}
+	var b objectSource = newPagedIterator(svc.Context, src, q)
 
-	// image index
-	idx := 0
+	// explicit object names replace the listing
+	if svc.NamesFile != "" {
+		it, err := newNamesIterator(svc, src, svc.NamesFile)
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		b = it
+		level.Info(l).Log("msg", "processing object names from file", "path", svc.NamesFile)
+	}
 
-	// bucket handler
-	dst := svc.Client.Bucket(svc.DstBucketName)
-	src := svc.Client.Bucket(svc.SrcBucketName)
-	level.Info(l).Log("msg", "dst bucket", "name", svc.DstBucketName)
-	level.Info(l).Log("msg", "src bucket", "name", svc.SrcBucketName)
+	// spread the first listing of replicas started together
+	if err := svc.sleepJitter(); err != nil {
+		return err
+	}
 
-	q := &storage.Query{}
-	if svc.Prefix != "" {
-		q = &storage.Query{
-			// Prefix: fmt.Sprintf("%s/", svc.Prefix),
-			MatchGlob: fmt.Sprintf("%s/*.jpg", svc.Prefix),
+	switch svc.Mode {
+	case "", modeScan:
+	case modeVerify:
+		svc.Ready.Store(true)
+		level.Info(l).Log("msg", "verification started", "workers", svc.Workers, "limit", svc.Limit, "glob", q.MatchGlob)
+		return svc.verify(b, dst)
+	case modeReport:
+		if svc.DupesOnly {
+			svc.Ready.Store(true)
+			return svc.reportClusters()
+		}
+		if err := svc.initHasher(); err != nil {
+			return err
+		}
+		svc.Ready.Store(true)
+		level.Info(l).Log("msg", "report started", "workers", svc.Workers, "limit", svc.Limit, "glob", q.MatchGlob, "format", svc.ReportFormat, "sample_percent", svc.SamplePercent)
+		return svc.report(b, src)
+	case modeReconcile:
+		if err := svc.migrate(); err != nil {
+			return err
 		}
+		svc.Ready.Store(true)
+		return svc.reconcile(src, dst)
+	case modeList:
+		svc.Ready.Store(true)
+		return svc.list(b)
+	case modeGC:
+		if err := svc.migrate(); err != nil {
+			return err
+		}
+		svc.Ready.Store(true)
+		return svc.gc(src, dst)
+	case modePromote:
+		if err := svc.migrate(); err != nil {
+			return err
+		}
+		svc.Ready.Store(true)
+		return svc.promote(src, dst)
+	default:
+		return fmt.Errorf("unknown mode %q", svc.Mode)
 	}
-	b := src.Objects(svc.Context, q)
 
-	// Set up table
-	err := crdbpgx.ExecuteTx(svc.Context, svc.Roach, pgx.TxOptions{}, func(tx pgx.Tx) error {
-		return initTable(svc.Context, tx)
-	})
-	if err != nil {
+	// dedup key
+	if err := svc.initHasher(); err != nil {
 		return err
 	}
 
-	// start service
-	svc.Ready = true
-	level.Info(l).Log("msg", "service ready", "limit", svc.Limit, "glob", q.MatchGlob)
-
-	for svc.Ready {
-		// limit the objects processed by count
-		idx++
-		if svc.Limit != 0 && idx > svc.Limit {
-			level.Info(l).Log("msg", "limit reached", "limit", svc.Limit)
-			break
+	// a fresh dst is created before the preflight checks it
+	if svc.CreateDst {
+		if err := svc.ensureDstBucket(svc.Context, dst); err != nil {
+			return err
 		}
+	}
 
-		// get next object
-		attrs, err := b.Next()
-		if err == iterator.Done {
-			break
+	// check bucket permissions before processing
+	if svc.Preflight {
+		if err := svc.preflight(svc.Context, src, dst); err != nil {
+			return err
 		}
+	}
+
+	if err := svc.migrate(); err != nil {
+		return err
+	}
+
+	// event sinks, flushed once every object is processed
+	defer svc.closeSinks()
+	if svc.Manifest != "" {
+		m, err := NewManifest(svc.DstClient, svc.Manifest)
 		if err != nil {
-			level.Error(l).Log("msg", "failed to get next bucket object", "error", err)
+			return err
 		}
+		svc.sinks = append(svc.sinks, m)
+		level.Info(l).Log("msg", "writing manifest", "path", svc.Manifest)
+	}
+	if svc.BigQueryTable != "" {
+		bq, err := newBigQuerySink(svc.Context, svc.BigQueryTable, svc.RunID, svc.BigQueryBatch)
+		if err != nil {
+			return err
+		}
+		svc.sinks = append(svc.sinks, bq)
+		level.Info(l).Log("msg", "streaming events to bigquery", "table", svc.BigQueryTable, "batch", svc.BigQueryBatch)
+	}
 
-		// process image
-		processImage(svc.Context, svc.Roach, src, dst, attrs)
+	// start service
+	defer svc.summarize()
+	defer svc.seen.reset()
+	svc.Ready.Store(true)
+	if err := insertRun(svc.Context, svc.Roach, svc.RunID, svc.config); err != nil {
+		return err
 	}
+	level.Info(l).Log("msg", "service ready", "run_id", svc.RunID, "workers", svc.Workers, "limit", svc.Limit, "copy_limit", svc.CopyLimit, "glob", q.MatchGlob)
+
+	// look the crc32 of a whole batch up at once, shards first so only this
+	// replica's objects are looked up
+	b = svc.batchCheck(svc.shardObjects(b))
+	err = svc.forEachObject(b, func(ctx context.Context, attrs *storage.ObjectAttrs) {
+		// with -drain-on-db-error an object failed by a database outage is
+		// processed again once the database answers
+		for {
+			outage := svc.processImage(ctx, src, dst, attrs)
+			if outage == nil {
+				return
+			}
+			if err := svc.pause.await(ctx, outage); err != nil {
+				level.Warn(l).Log("msg", "object abandoned while the database was unavailable", "name", attrs.Name, "error", err)
+				return
+			}
+		}
+	})
+	svc.finishRun(err)
+	return err
+}
 
+// initHasher sets up the dedup key strategy.
+func (svc *ImgDeduper) initHasher() error {
+	h, err := newHasher(svc.HashStrategy)
+	if err != nil {
+		return err
+	}
+	svc.Hasher = h
 	return nil
 }
 
-func processImage(ctx context.Context, roach *pgx.Conn, src, dst *storage.BucketHandle, attrs *storage.ObjectAttrs) {
-	l := loggerFromContext(ctx)
-	s := strings.Split(attrs.Name, "/")[0]
-	count := 0
-	status := "skip"
+// countObject increments objectProcessed. The section label is only set when
+// section metrics are enabled, and limited to the allowlist if one is given.
+func (svc *ImgDeduper) countObject(status, operation, section string) {
+	svc.metrics.objectProcessed.With(prometheus.Labels{
+		"status":    status,
+		"operation": operation,
+		"section":   svc.sectionLabel(section),
+	}).Inc()
+}
 
-	// check if image exists in database
-	count, err := getImageCount(ctx, roach, attrs.CRC32C)
-	if err != nil {
-		level.Error(l).Log("msg", "failed to count existing image", "name", attrs.Name, "error", err)
-		objectProcessed.With(prometheus.Labels{"status": "error"}).Inc()
-		return
-	} else {
-		level.Debug(l).Log("msg", "count", "section", s, "name", attrs.Name, "count", count, "crc32", attrs.CRC32C)
+func (svc *ImgDeduper) sectionLabel(section string) string {
+	switch {
+	case len(svc.sectionAllow) > 0:
+		if svc.sectionAllow[section] {
+			return section
+		}
+		return "other"
+	case svc.SectionLabels:
+		return section
+	default:
+		return ""
 	}
+}
 
-	// database insert
-	if err := insertImage(ctx, roach, attrs, s); err != nil {
-		objectProcessed.With(prometheus.Labels{"status": "error"}).Inc()
-		level.Error(l).Log("msg", "failed to insert image", "name", attrs.Name, "error", err)
+// summarize logs the run counters and writes the summary file if configured.
+func (svc *ImgDeduper) summarize() {
+	l := loggerFromContext(svc.Context)
+	st := svc.stats.Snapshot()
+	level.Info(l).Log("msg", "run summary",
+		"processed", st.Processed,
+		"copied", st.Copied,
+		"skipped", st.Skipped,
+		"errored", st.Errored,
+		"bytes", st.Bytes,
+		"elapsed", st.Elapsed)
+
+	if svc.SummaryFile == "" {
 		return
-	} else {
-		level.Debug(l).Log("msg", "insert", "section", s, "name", attrs.Name, "count", count,  "crc32", attrs.CRC32C)
-	}
-
-	// objects
-	if count == 0 {
-		status = "copy"
-		level.Debug(l).Log("msg", "init copy", "section", s, "name", attrs.Name, "count", count,  "crc32", attrs.CRC32C)
-		srcObj := src.Object(attrs.Name)
-		dstObj := dst.Object(attrs.Name)
-		// https://cloud.google.com/storage/docs/copying-renaming-moving-objects#client-libraries
-		dstObj = dstObj.If(storage.Conditions{DoesNotExist: true})
-
-		if _, err := dstObj.CopierFrom(srcObj).Run(ctx); err != nil {
-			level.Error(l).Log("msg", "copy", "section", s, "name", attrs.Name, "count", count,"crc32", attrs.CRC32C, "error", err)
-			objectProcessed.With(prometheus.Labels{"status": "error", "operation": status}).Inc()
-			return
-		} else {
-			level.Debug(l).Log("msg", "copy", "section", s, "name", attrs.Name, "count", count,  "crc32", attrs.CRC32C)
-		}
 	}
+	if err := writeSummary(svc.SummaryFile, RunSummary{Stats: st, Config: svc.config}); err != nil {
+		level.Error(l).Log("msg", "failed to write summary", "path", svc.SummaryFile, "error", err)
+	}
+}
+
+// reserveCopy claims one of the CopyLimit copies. Once the limit is reached
+// the service is stopped and false is returned.
+func (svc *ImgDeduper) reserveCopy() bool {
+	if svc.CopyLimit == 0 {
+		return true
+	}
+	if svc.copies.Add(1) <= int64(svc.CopyLimit) {
+		return true
+	}
+	svc.copies.Add(-1)
+	if svc.Ready.CompareAndSwap(true, false) {
+		l := loggerFromContext(svc.Context)
+		level.Info(l).Log("msg", "copy limit reached", "copy_limit", svc.CopyLimit)
+	}
+	return false
+}
 
-	objectProcessed.With(prometheus.Labels{"status": "success", "operation": status}).Inc()
-	level.Info(l).Log("msg", "image", "section", s, "name", attrs.Name, "count", count, "crc32", attrs.CRC32C, "status", status)
+// releaseCopy returns a reserved copy after a failed copy.
+func (svc *ImgDeduper) releaseCopy() {
+	if svc.CopyLimit != 0 {
+		svc.copies.Add(-1)
+	}
 }
 
-// Stop instructs the service to stop processing new messages.
-func (svc *ImgDeduper) Stop() {
+// Stop instructs the service to stop processing new messages and waits up to
+// DrainTimeout for in-flight objects to complete. Once the deadline passes the
+// service context is cancelled. It returns true when the drain completed.
+func (svc *ImgDeduper) Stop() bool {
 	l := loggerFromContext(svc.Context)
-	level.Info(l).Log("msg", "stopping service")
-	svc.Ready = false
+	level.Info(l).Log("msg", "stopping service", "drain_timeout", svc.DrainTimeout)
+	svc.Ready.Store(false)
+
+	t := time.NewTimer(svc.DrainTimeout)
+	defer t.Stop()
+	select {
+	case <-svc.done:
+		level.Info(l).Log("msg", "service drained")
+		return true
+	case <-t.C:
+		level.Warn(l).Log("msg", "drain timeout exceeded, cancelling in-flight objects", "drain_timeout", svc.DrainTimeout)
+		svc.cancel()
+		return false
+	}
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"cloud.google.com/go/storage"
+)
+
+// validateShard checks -shard-index against -shard-count.
+func (svc *ImgDeduper) validateShard() error {
+	if svc.ShardCount < 1 {
+		return fmt.Errorf("shard count %d, expected at least 1", svc.ShardCount)
+	}
+	if svc.ShardIndex < 0 || svc.ShardIndex >= svc.ShardCount {
+		return fmt.Errorf("shard index %d, expected 0 to %d", svc.ShardIndex, svc.ShardCount-1)
+	}
+	return nil
+}
+
+// inShard reports whether name belongs to this replica's shard. The shard
+// is the 64-bit FNV-1a hash of the name modulo the shard count, so every
+// replica assigns a name to the same shard regardless of listing order.
+func (svc *ImgDeduper) inShard(name string) bool {
+	if svc.ShardCount <= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()%uint64(svc.ShardCount) == uint64(svc.ShardIndex)
+}
+
+// shardObjects returns b, limited to the replica's shard with -shard-count.
+// A source already limited is returned as is.
+func (svc *ImgDeduper) shardObjects(b objectSource) objectSource {
+	if _, ok := b.(*shardSource); ok || svc.ShardCount <= 1 {
+		return b
+	}
+	return &shardSource{svc: svc, b: b}
+}
+
+// shardSource yields only the objects of the replica's shard, the others
+// are dropped before they reach a worker or count toward -limit.
+type shardSource struct {
+	svc *ImgDeduper
+	b   objectSource
+}
+
+func (s *shardSource) Next() (*storage.ObjectAttrs, error) {
+	for {
+		attrs, err := s.b.Next()
+		if err != nil || s.svc.inShard(attrs.Name) {
+			return attrs, err
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultSectionStats caps the sections tallied apart in the run stats.
+const defaultSectionStats = 100
+
+// otherSection tallies the sections past the cap.
+const otherSection = "other"
+
+// RunStats are the counters of the current run.
+type RunStats struct {
+	start     time.Time
+	processed atomic.Int64
+	copied    atomic.Int64
+	skipped   atomic.Int64
+	errored   atomic.Int64
+	bytes     atomic.Int64
+	listed    atomic.Int64
+	handled   atomic.Int64
+	cursor    atomic.Value
+	sections  *sectionStats
+}
+
+// StatsSnapshot is a point in time copy of the run counters.
+type StatsSnapshot struct {
+	Processed int64   `json:"processed"`
+	Copied    int64   `json:"copied"`
+	Skipped   int64   `json:"skipped"`
+	Errored   int64   `json:"errored"`
+	Bytes     int64   `json:"bytes"`
+	Listed    int64   `json:"listed"`
+	Lag       int64   `json:"lag"`
+	Elapsed   float64 `json:"elapsed_seconds"`
+	Cursor    string  `json:"cursor"`
+	// DBPaused is set while -drain-on-db-error holds the scan for the
+	// database, paused for PausedFor seconds
+	DBPaused  bool    `json:"db_paused"`
+	PausedFor float64 `json:"db_paused_seconds,omitempty"`
+	// Sections are the outcomes per section, the sections past the
+	// -section-stats cap tallied together as other
+	Sections map[string]SectionSnapshot `json:"sections,omitempty"`
+}
+
+// SectionSnapshot are the outcomes of one section. DuplicateRatio is the
+// share of duplicates among the section's copied and duplicate objects.
+type SectionSnapshot struct {
+	Copied         int64   `json:"copied"`
+	Duplicates     int64   `json:"duplicates"`
+	Skipped        int64   `json:"skipped"`
+	Errored        int64   `json:"errored"`
+	DuplicateRatio float64 `json:"duplicate_ratio"`
+}
+
+// sectionStats tallies outcomes per section, the first max sections seen
+// apart and the rest as otherSection. A nil sectionStats tallies nothing.
+type sectionStats struct {
+	mu       sync.Mutex
+	max      int
+	sections map[string]*SectionSnapshot
+	// ratio is set to the duplicate ratio of a section, nil without
+	// -section-ratio-metrics
+	ratio *prometheus.GaugeVec
+}
+
+func newSectionStats(max int, ratio *prometheus.GaugeVec) *sectionStats {
+	if max <= 0 {
+		return nil
+	}
+	return &sectionStats{max: max, sections: make(map[string]*SectionSnapshot), ratio: ratio}
+}
+
+// observe tallies the outcome of an object of section. Dedup skips, tagged
+// or not, are duplicates, other skips only count as skipped.
+func (s *sectionStats) observe(section, status string, failed bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.sections[section]
+	if !ok {
+		if len(s.sections) >= s.max {
+			section = otherSection
+		}
+		if c, ok = s.sections[section]; !ok {
+			c = &SectionSnapshot{}
+			s.sections[section] = c
+		}
+	}
+	switch {
+	case failed:
+		c.Errored++
+	case status == "copy":
+		c.Copied++
+	case status == "skip" || status == "tag":
+		c.Duplicates++
+	case strings.HasPrefix(status, "skip"):
+		c.Skipped++
+	default:
+		return
+	}
+	if n := c.Copied + c.Duplicates; n > 0 {
+		c.DuplicateRatio = float64(c.Duplicates) / float64(n)
+	}
+	if s.ratio != nil {
+		s.ratio.With(prometheus.Labels{"section": section}).Set(c.DuplicateRatio)
+	}
+}
+
+// snapshot copies the section tallies, nil when none are kept.
+func (s *sectionStats) snapshot() map[string]SectionSnapshot {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := make(map[string]SectionSnapshot, len(s.sections))
+	for section, c := range s.sections {
+		m[section] = *c
+	}
+	return m
+}
+
+// RunSummary is written on shutdown along with the effective configuration.
+type RunSummary struct {
+	Stats  StatsSnapshot `json:"stats"`
+	Config SvcOptions    `json:"config"`
+}
+
+func newRunStats(sections *sectionStats) *RunStats {
+	return &RunStats{start: time.Now(), sections: sections}
+}
+
+// observe tallies the outcome of a processed object of section.
+func (r *RunStats) observe(section, status string, failed bool, size int64) {
+	r.sections.observe(section, status, failed)
+	r.processed.Add(1)
+	switch {
+	case failed:
+		r.errored.Add(1)
+	case status == "copy":
+		r.copied.Add(1)
+		r.bytes.Add(size)
+	case strings.HasPrefix(status, "skip"):
+		r.skipped.Add(1)
+	}
+}
+
+// lag returns how many listed objects are not handled yet, queued or in
+// progress. A lag that keeps growing means the workers can't keep up with
+// the listing.
+func (r *RunStats) lag() int64 {
+	return r.listed.Load() - r.handled.Load()
+}
+
+// setCursor records the name of the last listed object.
+func (r *RunStats) setCursor(name string) {
+	r.cursor.Store(name)
+}
+
+// Snapshot returns the current counters.
+func (r *RunStats) Snapshot() StatsSnapshot {
+	cursor, _ := r.cursor.Load().(string)
+	return StatsSnapshot{
+		Processed: r.processed.Load(),
+		Copied:    r.copied.Load(),
+		Skipped:   r.skipped.Load(),
+		Errored:   r.errored.Load(),
+		Bytes:     r.bytes.Load(),
+		Listed:    r.listed.Load(),
+		Lag:       r.lag(),
+		Elapsed:   time.Since(r.start).Seconds(),
+		Cursor:    cursor,
+		Sections:  r.sections.snapshot(),
+	}
+}
+
+// writeSummary writes the run summary as JSON to path, or stdout for "-".
+func writeSummary(path string, s RunSummary) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultTestTimeout bounds the whole test-connection run.
+const defaultTestTimeout = 5 * time.Second
+
+// connCheck is a dependency test-connection reaches.
+type connCheck struct {
+	name string
+	run  func(context.Context) error
+}
+
+// testConnection pings the database and reads the src and dst bucket attrs
+// concurrently within svcOpts.TestTimeout, without the service, web server or
+// logger. It writes one result line per dependency to w and returns the exit
+// code, exitCodeErr when any failed.
+func testConnection(w io.Writer, svcOpts SvcOptions, dbOpts DBOptions, storageOpts StorageOptions) int {
+	timeout := svcOpts.TestTimeout
+	if timeout <= 0 {
+		timeout = defaultTestTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	bucketCheck := func(name string, o ClientOptions, userProject string) func(context.Context) error {
+		return func(ctx context.Context) error {
+			client, err := newStorageClient(ctx, o)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			b := client.Bucket(name)
+			if userProject != "" {
+				b = b.UserProject(userProject)
+			}
+			_, err = b.Attrs(ctx)
+			return err
+		}
+	}
+	// the dst client falls back to the src identity, as in main
+	dstOpts := storageOpts.Dst
+	if !dstOpts.IsSet() {
+		dstOpts = storageOpts.Src
+	}
+	checks := []connCheck{
+		{"db", func(ctx context.Context) error {
+			roach, err := openDatabase(ctx, dbOpts, svcOpts)
+			if err != nil {
+				return err
+			}
+			roach.Close()
+			return nil
+		}},
+		{"src", bucketCheck(svcOpts.SrcBucketName, storageOpts.Src, "")},
+		{"dst", bucketCheck(svcOpts.DstBucketName, dstOpts, svcOpts.DstProject)},
+	}
+
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c connCheck) {
+			defer wg.Done()
+			errs[i] = c.run(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	code := exitCodeSuccess
+	for i, c := range checks {
+		if errs[i] != nil {
+			fmt.Fprintf(w, "%s failed: %v\n", c.name, errs[i])
+			code = exitCodeErr
+			continue
+		}
+		fmt.Fprintf(w, "%s ok\n", c.name)
+	}
+	return code
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"google.golang.org/api/googleapi"
+)
+
+// validateChunkSize checks an upload chunk size, 0 keeps the client default.
+func validateChunkSize(size int) error {
+	if size < 0 || size%googleapi.MinUploadChunkSize != 0 {
+		return fmt.Errorf("chunk size %d must be a multiple of %d bytes", size, googleapi.MinUploadChunkSize)
+	}
+	return nil
+}
+
+const (
+	uploadAttempts = 4
+	uploadBackoff  = time.Second
+)
+
+// transformAndCopy downloads src, re-encodes it as a JPEG at the given
+// quality and uploads the result to dst in chunkSize chunks, 0 keeps the
+// client default. Any preconditions set on dst apply to the upload.
+func transformAndCopy(ctx context.Context, src, dst *storage.ObjectHandle, quality, chunkSize int) error {
+	r, err := src.NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	// encode once so a failed upload can be restarted from the start
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+	return uploadWithRetry(ctx, dst, buf.Bytes(), chunkSize)
+}
+
+// uploadWithRetry uploads b to dst, restarting the whole upload when it fails
+// with a retryable error until ctx, bounded by -object-timeout, is done. The
+// writer retries single chunks, this covers an upload failing on Close.
+func uploadWithRetry(ctx context.Context, dst *storage.ObjectHandle, b []byte, chunkSize int) error {
+	m := metricsFromContext(ctx)
+	l := loggerFromContext(ctx)
+
+	for attempt := 1; ; attempt++ {
+		err := upload(ctx, dst, b, chunkSize)
+		if err == nil {
+			m.uploadBytes.Add(float64(len(b)))
+			return nil
+		}
+		if attempt == uploadAttempts || !storage.ShouldRetry(err) || ctx.Err() != nil {
+			return err
+		}
+
+		m.uploadRetries.Inc()
+		level.Warn(l).Log("msg", "upload failed, restarting", "dst", dst.ObjectName(), "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * uploadBackoff):
+		}
+	}
+}
+
+// upload writes b to dst in a single upload. The object is only created once
+// the upload is finalized, a failed write cancels it instead of closing the
+// writer so no partial object is left behind.
+func upload(ctx context.Context, dst *storage.ObjectHandle, b []byte, chunkSize int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := dst.NewWriter(ctx)
+	w.ContentType = "image/jpeg"
+	if chunkSize > 0 {
+		w.ChunkSize = chunkSize
+	}
+	if _, err := w.Write(b); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
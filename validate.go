@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	crdbpgx "github.com/cockroachdb/cockroach-go/v2/crdb/crdbpgxv5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// validateImage downloads the object and fully decodes it. A read failure is
+// returned as err, a decode failure, e.g. a truncated JPEG, as corrupt.
+func (svc *ImgDeduper) validateImage(ctx context.Context, obj *storage.ObjectHandle, name string) (corrupt, err error) {
+	ctx, span := tracer.Start(ctx, "validate")
+	defer span.End()
+
+	var r io.ReadCloser
+	if svc.SrcURL != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, svc.srcURL(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("get: %s", resp.Status)
+		}
+		r = resp.Body
+	} else if r, err = obj.NewReader(ctx); err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// read fully first so a truncated download isn't reported as corrupt
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := image.Decode(bytes.NewReader(b)); err != nil {
+		return err, nil
+	}
+	return nil, nil
+}
+
+// insertFailedImage records an object that failed validation for review. It
+// uses crdbpgx for transaction handling (retries).
+func insertFailedImage(ctx context.Context, roach *pgxpool.Pool, name, reason string) error {
+	return retryConn(ctx, "insert_failed", func() error {
+		return crdbpgx.ExecuteTx(ctx, txConn(ctx, roach), pgx.TxOptions{}, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "UPSERT INTO failed_images (name, reason, failed_at) VALUES ($1, $2, now())", name, reason)
+			return err
+		})
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// verifyCounts tallies the outcome of a verification pass.
+type verifyCounts struct {
+	match    atomic.Int64
+	missing  atomic.Int64
+	mismatch atomic.Int64
+	errored  atomic.Int64
+}
+
+// verify checks that every listed src object exists in dst with a matching
+// crc32. Nothing is copied or written to the database. An error is returned
+// when any discrepancy is found.
+func (svc *ImgDeduper) verify(b objectSource, dst *storage.BucketHandle) error {
+	l := loggerFromContext(svc.Context)
+
+	var c verifyCounts
+	err := svc.forEachObject(b, func(_ context.Context, attrs *storage.ObjectAttrs) {
+		svc.verifyImage(dst, attrs, &c)
+	})
+
+	level.Info(l).Log("msg", "verification summary",
+		"match", c.match.Load(),
+		"missing", c.missing.Load(),
+		"mismatch", c.mismatch.Load(),
+		"error", c.errored.Load())
+
+	if err != nil {
+		return err
+	}
+	if n := c.missing.Load() + c.mismatch.Load() + c.errored.Load(); n > 0 {
+		return fmt.Errorf("verification found %d discrepancies", n)
+	}
+	return nil
+}
+
+func (svc *ImgDeduper) verifyImage(dst *storage.BucketHandle, attrs *storage.ObjectAttrs, c *verifyCounts) {
+	l := loggerFromContext(svc.Context)
+	result := "match"
+
+	// content type routes pick the bucket as in the scan
+	route, dstName, err := svc.routeObject(dst, attrs)
+	if err != nil {
+		level.Error(l).Log("msg", "failed to rewrite destination name", "name", attrs.Name, "error", err)
+		svc.metrics.objectVerified.With(prometheus.Labels{"result": "error"}).Inc()
+		c.errored.Add(1)
+		return
+	}
+
+	dstAttrs, err := route.Object(dstName).Attrs(svc.Context)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		result = "missing"
+		c.missing.Add(1)
+	case err != nil:
+		result = "error"
+		c.errored.Add(1)
+		level.Error(l).Log("msg", "failed to get dst object attrs", "name", attrs.Name, "dst", dstName, "error", err)
+	case dstAttrs.CRC32C != attrs.CRC32C:
+		result = "mismatch"
+		c.mismatch.Add(1)
+	default:
+		c.match.Add(1)
+	}
+
+	svc.metrics.objectVerified.With(prometheus.Labels{"result": result}).Inc()
+	if result == "match" {
+		level.Debug(l).Log("msg", "verify", "name", attrs.Name, "crc32", attrs.CRC32C, "result", result)
+		return
+	}
+	level.Warn(l).Log("msg", "verify", "name", attrs.Name, "dst", dstName, "crc32", attrs.CRC32C, "result", result)
+}
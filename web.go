@@ -2,21 +2,50 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"time"
 
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func startWebServer(ctx context.Context, svc Service, exit chan error, port string) {
+// listenAddress returns the host:port of -listen, or of the deprecated -port
+// on all interfaces when -listen is unset.
+func listenAddress(listen, port string) (string, error) {
+	if listen == "" {
+		listen = ":" + port
+	}
+	_, p, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", fmt.Errorf("listen address %q: %w", listen, err)
+	}
+	if _, err := net.LookupPort("tcp", p); err != nil {
+		return "", fmt.Errorf("listen address %q: %w", listen, err)
+	}
+	return listen, nil
+}
+
+// startWebServer serves metrics, health and stats on addr. The pprof handlers
+// are only mounted when enablePprof is set; they share the address and must
+// only be exposed internally.
+func startWebServer(ctx context.Context, svc Service, exit chan error, addr string, enablePprof bool) {
 	l := loggerFromContext(ctx)
 
 	go func() {
-		p := ":" + port
-		http.Handle("/metrics", promhttp.Handler())
-		http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			exit <- err
+			return
+		}
+		p := ln.Addr().String()
+		// a dedicated mux, net/http/pprof registers itself on the default one
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 			if svc.IsReady() {
 				w.WriteHeader(http.StatusOK)
 				_, _ = w.Write([]byte("ready"))
@@ -25,13 +54,74 @@ func startWebServer(ctx context.Context, svc Service, exit chan error, port stri
 			w.WriteHeader(http.StatusInternalServerError)
 			_, _ = w.Write([]byte("not ready"))
 		})
-		level.Info(l).Log("msg", fmt.Sprintf("Serving '/metrics' on port %s", p))
-		level.Info(l).Log("msg", fmt.Sprintf("Serving '/health' on port %s", p))
+		readiness := &readinessCache{svc: svc}
+		mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+			if err := readiness.check(r.Context()); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("ready"))
+		})
+		mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(svc.Stats())
+		})
+		mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+				return
+			}
+
+			events, unsubscribe := svc.Subscribe()
+			defer unsubscribe()
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+			flusher.Flush()
+
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case ev, ok := <-events:
+					if !ok {
+						return
+					}
+					b, err := json.Marshal(ev)
+					if err != nil {
+						continue
+					}
+					if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+						return
+					}
+					flusher.Flush()
+				}
+			}
+		})
+		// the resolved listen address stays at info, the endpoints at debug
+		level.Info(l).Log("msg", fmt.Sprintf("Serving '/metrics' on %s", p), "addr", p)
+		level.Debug(l).Log("msg", fmt.Sprintf("Serving '/health' on %s", p))
+		level.Debug(l).Log("msg", fmt.Sprintf("Serving '/readyz' on %s", p))
+		level.Debug(l).Log("msg", fmt.Sprintf("Serving '/stats' on %s", p))
+		level.Debug(l).Log("msg", fmt.Sprintf("Serving '/events' on %s", p))
+
+		if enablePprof {
+			mux.HandleFunc("/debug/pprof/", pprof.Index)
+			mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+			level.Info(l).Log("msg", fmt.Sprintf("Serving '/debug/pprof/' on %s", p))
+		}
 
 		server := &http.Server{
-			Addr:              p,
+			Handler:           mux,
 			ReadHeaderTimeout: 30 * time.Second,
 		}
-		exit <- server.ListenAndServe()
+		exit <- server.Serve(ln)
 	}()
 }
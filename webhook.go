@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+const (
+	webhookAttempts = 3
+	// webhookTimeout bounds a single POST so a slow webhook can't hold up
+	// shutdown for long.
+	webhookTimeout = 5 * time.Second
+	webhookBackoff = time.Second
+)
+
+// webhookPayload is POSTed to -webhook-url once a run ends. Text makes it
+// readable as a Slack incoming webhook message.
+type webhookPayload struct {
+	Text   string        `json:"text"`
+	RunID  string        `json:"run_id"`
+	Mode   string        `json:"mode"`
+	Status string        `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	Src    string        `json:"src"`
+	Dst    string        `json:"dst,omitempty"`
+	Stats  StatsSnapshot `json:"stats"`
+}
+
+// notifyWebhook reports how the run ended, see runStatus.
+// Failed POSTs are retried a few times, a webhook that stays down only
+// logs an error.
+func (svc *ImgDeduper) notifyWebhook(err error) {
+	if svc.WebhookURL == "" {
+		return
+	}
+	l := loggerFromContext(svc.Context)
+
+	status := svc.runStatus(err)
+	mode := svc.Mode
+	if mode == "" {
+		mode = modeScan
+	}
+	stats := svc.stats.Snapshot()
+	p := webhookPayload{
+		Text: fmt.Sprintf("%s run %s %s: %d processed, %d copied, %d skipped, %d errors in %.0fs",
+			mode, svc.RunID, status, stats.Processed, stats.Copied, stats.Skipped, stats.Errored, stats.Elapsed),
+		RunID:  svc.RunID,
+		Mode:   mode,
+		Status: status,
+		Src:    svc.SrcBucketName,
+		Dst:    svc.DstBucketName,
+		Stats:  stats,
+	}
+	if err != nil {
+		p.Error = err.Error()
+		p.Text += ", error: " + p.Error
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		level.Error(l).Log("msg", "failed to encode webhook payload", "error", err)
+		return
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(client, svc.WebhookURL, b)
+		if err == nil {
+			level.Info(l).Log("msg", "webhook notified", "status", status)
+			return
+		}
+		if attempt == webhookAttempts {
+			level.Error(l).Log("msg", "failed to notify webhook", "attempts", attempt, "error", err)
+			return
+		}
+		level.Warn(l).Log("msg", "failed to notify webhook, retrying", "attempt", attempt, "error", err)
+		time.Sleep(time.Duration(attempt) * webhookBackoff)
+	}
+}
+
+// postWebhook POSTs body as JSON. The service context may be cancelled by
+// the time the run ends, the client timeout bounds the request instead.
+func postWebhook(client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}